@@ -0,0 +1,510 @@
+package canaryrouter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/ratelimit"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
+)
+
+const (
+	// CircuitBreakerModeCount trips the circuit breaker once the total number of canary errors
+	// reaches error-limit-canary
+	CircuitBreakerModeCount = "count"
+
+	// CircuitBreakerModeErrorRate trips the circuit breaker while the canary error rate within
+	// the rolling window is above error-rate-threshold
+	CircuitBreakerModeErrorRate = "error-rate"
+
+	// RequestLimitModeTotal limits the number of canary requests for the process lifetime
+	RequestLimitModeTotal = "total"
+
+	// RequestLimitModeRate limits the number of canary requests per request-limit-interval, the limit
+	// is refilled continuously
+	RequestLimitModeRate = "rate"
+
+	defaultErrorRateWindow = 60
+
+	defaultRequestLimitInterval = 1
+
+	defaultHalfOpenRequests = 1
+
+	defaultLatencyPercentile = 99
+)
+
+// newRequestLimitBucket returns nil if breakerConfig has no request limit
+func newRequestLimitBucket(breakerConfig config.CircuitBreaker) (*ratelimit.Bucket, error) {
+	if breakerConfig.RequestLimitCanary == 0 {
+		return nil, nil
+	}
+
+	switch breakerConfig.RequestLimitMode {
+	case "", RequestLimitModeTotal:
+		return ratelimit.NewBucket(infinityDuration, int64(breakerConfig.RequestLimitCanary)), nil
+	case RequestLimitModeRate:
+		interval := breakerConfig.RequestLimitInterval
+		if interval == 0 {
+			interval = defaultRequestLimitInterval
+		}
+		if interval < 0 {
+			return nil, errors.Errorf("circuit-breaker request-limit-interval must be positive, got %d", interval)
+		}
+
+		burst := breakerConfig.RequestLimitBurst
+		if burst == 0 {
+			burst = breakerConfig.RequestLimitCanary
+		}
+
+		rate := float64(breakerConfig.RequestLimitCanary) / float64(interval)
+
+		return ratelimit.NewBucketWithRate(rate, int64(burst)), nil
+	default:
+		return nil, errors.Errorf("circuit-breaker request-limit-mode %q is not recognized", breakerConfig.RequestLimitMode)
+	}
+}
+
+// breakerState is the state of a canary (or sidecar) circuit breaker, its value is exported as a gauge
+type breakerState int
+
+const (
+	// breakerClosed lets the requests through to canary
+	breakerClosed breakerState = iota
+	// breakerOpen forwards the requests to main instead of canary
+	breakerOpen
+	// breakerHalfOpen lets a few probe requests through to canary, to decide whether it has recovered
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var probeKey = contextKey("probe")
+
+// markProbe marks the request as a half-open probe, so that its outcome decides the breaker state
+func markProbe(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), probeKey, true))
+}
+
+func isProbe(req *http.Request) bool {
+	probe, _ := req.Context().Value(probeKey).(bool)
+	return probe
+}
+
+// circuitBreaker trips when a canary target returns too many errors, either in total (count mode)
+// or relatively to its traffic (error-rate mode), or when it gets too slow. Once tripped, it is open until the cool-down has
+// elapsed, then half-open: the next probe requests are let through to canary, and the breaker closes
+// again if all of them succeed, or re-opens if any of them fails. Without cool-down, the breaker
+// closes as soon as its trip condition clears, which never happens in count mode.
+// Probe requests are only judged by their status code, as their latency is not known yet when it is recorded.
+type circuitBreaker struct {
+	errorLimit       uint64
+	errorLimitBucket *ratelimit.Bucket
+	errorRateWindow  *errorRateWindow
+
+	// latencyWindow is only set when a latency limit is configured, mainLatencyWindow is shared by all
+	// the targets of a route, and only set when a latency ratio limit is configured
+	latencyWindow     *latencyWindow
+	mainLatencyWindow *latencyWindow
+	latencyPercentile float64
+	latencyThreshold  time.Duration
+	latencyRatio      float64
+	minRequests       uint64
+
+	coolDown         time.Duration
+	halfOpenRequests int
+
+	describe  func(msg string) string
+	metricCtx context.Context
+
+	mu              sync.Mutex
+	state           breakerState
+	reason          string
+	openedAt        time.Time
+	probesTaken     int
+	probesSucceeded int
+}
+
+// newCircuitBreaker returns nil if breakerConfig has neither error limit nor latency limit
+func newCircuitBreaker(breakerConfig config.CircuitBreaker, mainLatencyWindow *latencyWindow, describe func(string) string, metricCtx context.Context) (*circuitBreaker, error) {
+	b := &circuitBreaker{
+		coolDown:         time.Duration(breakerConfig.CoolDown) * time.Second,
+		halfOpenRequests: breakerConfig.HalfOpenRequests,
+		describe:         describe,
+		metricCtx:        metricCtx,
+	}
+
+	hasLatencyLimit := breakerConfig.LatencyThreshold != 0 || breakerConfig.LatencyRatio != 0
+
+	switch breakerConfig.Mode {
+	case "", CircuitBreakerModeCount:
+		if breakerConfig.ErrorLimitCanary == 0 && !hasLatencyLimit {
+			return nil, nil
+		}
+
+		if breakerConfig.ErrorLimitCanary != 0 {
+			b.errorLimit = breakerConfig.ErrorLimitCanary
+			b.errorLimitBucket = ratelimit.NewBucket(infinityDuration, int64(b.errorLimit))
+		}
+	case CircuitBreakerModeErrorRate:
+		errorRateWindow, err := newErrorRateWindow(breakerConfig)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		b.errorRateWindow = errorRateWindow
+	default:
+		return nil, errors.Errorf("circuit-breaker mode %q is not recognized", breakerConfig.Mode)
+	}
+
+	if hasLatencyLimit {
+		if err := b.setLatencyLimit(breakerConfig, mainLatencyWindow); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if breakerConfig.CoolDown < 0 {
+		return nil, errors.Errorf("circuit-breaker cool-down must be positive, got %d", breakerConfig.CoolDown)
+	}
+
+	if b.halfOpenRequests == 0 {
+		b.halfOpenRequests = defaultHalfOpenRequests
+	}
+	if b.halfOpenRequests < 0 {
+		return nil, errors.Errorf("circuit-breaker half-open-requests must be positive, got %d", breakerConfig.HalfOpenRequests)
+	}
+
+	instrumentation.RecordCircuitBreakerState(b.metricCtx, int(b.state))
+
+	return b, nil
+}
+
+func (b *circuitBreaker) setLatencyLimit(breakerConfig config.CircuitBreaker, mainLatencyWindow *latencyWindow) error {
+	b.latencyPercentile = breakerConfig.LatencyPercentile
+	if b.latencyPercentile == 0 {
+		b.latencyPercentile = defaultLatencyPercentile
+	}
+	if b.latencyPercentile < 0 || b.latencyPercentile > 100 {
+		return errors.Errorf("circuit-breaker latency-percentile must be between 0 and 100, got %v", breakerConfig.LatencyPercentile)
+	}
+
+	if breakerConfig.LatencyThreshold < 0 {
+		return errors.Errorf("circuit-breaker latency-threshold must be positive, got %d", breakerConfig.LatencyThreshold)
+	}
+	b.latencyThreshold = time.Duration(breakerConfig.LatencyThreshold) * time.Millisecond
+
+	if breakerConfig.LatencyRatio < 0 {
+		return errors.Errorf("circuit-breaker latency-ratio must be positive, got %v", breakerConfig.LatencyRatio)
+	}
+	b.latencyRatio = breakerConfig.LatencyRatio
+
+	if b.latencyRatio != 0 {
+		if mainLatencyWindow == nil {
+			return errors.New("circuit-breaker latency-ratio requires main latency tracking")
+		}
+		b.mainLatencyWindow = mainLatencyWindow
+	}
+
+	b.latencyWindow = newLatencyWindow(breakerConfig.Window)
+	b.minRequests = breakerConfig.MinRequests
+
+	return nil
+}
+
+// latencyTripReason returns why the breaker should trip, or false if the latency limits have not been reached
+func (b *circuitBreaker) latencyTripReason(now time.Time) (string, bool) {
+	latency, requests := b.latencyWindow.percentile(b.latencyPercentile, now)
+	if requests == 0 || requests < b.minRequests {
+		return "", false
+	}
+
+	if b.latencyThreshold != 0 && latency > b.latencyThreshold {
+		return b.describe("latency limit reached"), true
+	}
+
+	if b.latencyRatio != 0 {
+		mainLatency, mainRequests := b.mainLatencyWindow.percentile(b.latencyPercentile, now)
+		if mainRequests > 0 && mainRequests >= b.minRequests && float64(latency) > b.latencyRatio*float64(mainLatency) {
+			return b.describe("latency ratio limit reached"), true
+		}
+	}
+
+	return "", false
+}
+
+// tripReason returns why the breaker should trip, or false if neither the error limits nor the latency
+// limits have been reached
+func (b *circuitBreaker) tripReason(now time.Time) (string, bool) {
+	if b.errorLimitBucket != nil && b.errorLimitBucket.Available() <= 0 {
+		return b.describe("error limit reached"), true
+	}
+
+	// NOTE: The reason is used as a metric tag, so it must not include the error rate itself
+	if b.errorRateWindow != nil {
+		if _, tripped := b.errorRateWindow.isTripped(now); tripped {
+			return b.describe("error rate limit reached"), true
+		}
+	}
+
+	if b.latencyWindow != nil {
+		return b.latencyTripReason(now)
+	}
+
+	return "", false
+}
+
+// transition changes the breaker state, b.mu must be held
+func (b *circuitBreaker) transition(state breakerState, now time.Time) {
+	if state == breakerOpen {
+		log.Printf("%s: %s -> %s (%s)", b.describe("circuit breaker"), b.state, state, b.reason)
+	} else {
+		log.Printf("%s: %s -> %s", b.describe("circuit breaker"), b.state, state)
+	}
+
+	b.state = state
+	switch state {
+	case breakerOpen:
+		b.openedAt = now
+	case breakerHalfOpen:
+		b.probesTaken = 0
+		b.probesSucceeded = 0
+	case breakerClosed:
+		b.reason = ""
+		if b.errorLimitBucket != nil {
+			b.errorLimitBucket = ratelimit.NewBucket(infinityDuration, int64(b.errorLimit))
+		}
+		if b.errorRateWindow != nil {
+			b.errorRateWindow.reset()
+		}
+		if b.latencyWindow != nil {
+			b.latencyWindow.reset()
+		}
+	}
+
+	instrumentation.RecordCircuitBreakerState(b.metricCtx, int(state))
+}
+
+// limitReason returns the reason why canary may not receive any more request, or false if the breaker
+// lets requests through
+func (b *circuitBreaker) limitReason(now time.Time) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		reason, tripped := b.tripReason(now)
+		if !tripped {
+			return "", false
+		}
+
+		b.reason = reason
+		b.transition(breakerOpen, now)
+	case breakerOpen:
+		if b.coolDown == 0 {
+			if _, tripped := b.tripReason(now); !tripped {
+				b.transition(breakerClosed, now)
+				return "", false
+			}
+		} else if now.Sub(b.openedAt) >= b.coolDown {
+			b.transition(breakerHalfOpen, now)
+			return "", false
+		}
+	case breakerHalfOpen:
+		if b.probesTaken < b.halfOpenRequests {
+			return "", false
+		}
+	}
+
+	return b.reason, true
+}
+
+// peekLimitReason returns the reason why the breaker is not closed, or would open, without changing its
+// state. Unlike limitReason, it never moves the breaker to half-open, so it is meant for observers such
+// as the ramp.
+func (b *circuitBreaker) peekLimitReason(now time.Time) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerClosed {
+		return b.tripReason(now)
+	}
+
+	return b.reason, true
+}
+
+// takeProbe marks the request as a probe when the breaker is half-open, it returns false if all
+// the probes have already been taken
+func (b *circuitBreaker) takeProbe(req *http.Request) (*http.Request, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerHalfOpen {
+		return req, true
+	}
+
+	if b.probesTaken >= b.halfOpenRequests {
+		return req, false
+	}
+
+	b.probesTaken++
+
+	return markProbe(req), true
+}
+
+// releaseProbe gives the probe taken by the request back, when the request could not be forwarded to
+// canary, so that its outcome is never recorded
+func (b *circuitBreaker) releaseProbe(req *http.Request) {
+	if !isProbe(req) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probesTaken > 0 {
+		b.probesTaken--
+	}
+}
+
+// record counts the outcome of a request forwarded to canary
+func (b *circuitBreaker) record(req *http.Request, isError bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if isProbe(req) {
+		if b.state != breakerHalfOpen {
+			return
+		}
+
+		if isError {
+			b.transition(breakerOpen, now)
+			return
+		}
+
+		b.probesSucceeded++
+		if b.probesSucceeded >= b.halfOpenRequests {
+			b.transition(breakerClosed, now)
+		}
+		return
+	}
+
+	if isError && b.errorLimitBucket != nil {
+		b.errorLimitBucket.TakeAvailable(1)
+	}
+
+	if b.errorRateWindow != nil {
+		b.errorRateWindow.record(isError, now)
+	}
+}
+
+// recordLatency counts the latency of a request served by canary
+func (b *circuitBreaker) recordLatency(latency time.Duration, now time.Time) {
+	if b.latencyWindow != nil {
+		b.latencyWindow.record(latency, now)
+	}
+}
+
+type errorRateSlot struct {
+	second   int64
+	requests uint64
+	errors   uint64
+}
+
+// errorRateWindow counts canary requests and errors over a rolling window, made of one second slots
+type errorRateWindow struct {
+	// threshold is the error ratio (0-1) above which the window is tripped
+	threshold   float64
+	minRequests uint64
+
+	mu    sync.Mutex
+	slots []errorRateSlot
+}
+
+func newErrorRateWindow(breakerConfig config.CircuitBreaker) (*errorRateWindow, error) {
+	if breakerConfig.ErrorRateThreshold <= 0 || breakerConfig.ErrorRateThreshold > 100 {
+		return nil, errors.Errorf("circuit-breaker error-rate-threshold must be greater than 0 and at most 100, got %v", breakerConfig.ErrorRateThreshold)
+	}
+
+	window := breakerConfig.Window
+	if window == 0 {
+		window = defaultErrorRateWindow
+	}
+	if window < 0 {
+		return nil, errors.Errorf("circuit-breaker window must be positive, got %d", window)
+	}
+
+	return &errorRateWindow{
+		threshold:   breakerConfig.ErrorRateThreshold / 100,
+		minRequests: breakerConfig.MinRequests,
+		slots:       make([]errorRateSlot, window),
+	}, nil
+}
+
+// record counts a canary response which happened at now
+func (w *errorRateWindow) record(isError bool, now time.Time) {
+	second := now.Unix()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	slot := &w.slots[second%int64(len(w.slots))]
+	if slot.second != second {
+		*slot = errorRateSlot{second: second}
+	}
+
+	slot.requests++
+	if isError {
+		slot.errors++
+	}
+}
+
+// reset forgets all the recorded requests
+func (w *errorRateWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.slots {
+		w.slots[i] = errorRateSlot{}
+	}
+}
+
+// errorRate returns the error ratio (0-1) and the number of requests within the window ending at now
+func (w *errorRateWindow) errorRate(now time.Time) (float64, uint64) {
+	second := now.Unix()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var requests, errs uint64
+	for _, slot := range w.slots {
+		if age := second - slot.second; age >= 0 && age < int64(len(w.slots)) {
+			requests += slot.requests
+			errs += slot.errors
+		}
+	}
+
+	if requests == 0 {
+		return 0, 0
+	}
+
+	return float64(errs) / float64(requests), requests
+}
+
+// isTripped returns the current error ratio, and whether it is above the threshold
+func (w *errorRateWindow) isTripped(now time.Time) (float64, bool) {
+	rate, requests := w.errorRate(now)
+
+	return rate, requests > 0 && requests >= w.minRequests && rate > w.threshold
+}
@@ -0,0 +1,308 @@
+package canaryrouter
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newErrorRateWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.CircuitBreaker
+		wantErr bool
+	}{
+		{name: "valid", args: config.CircuitBreaker{ErrorRateThreshold: 5, MinRequests: 20, Window: 60}, wantErr: false},
+		{name: "default window", args: config.CircuitBreaker{ErrorRateThreshold: 5}, wantErr: false},
+		{name: "missing threshold", args: config.CircuitBreaker{Window: 60}, wantErr: true},
+		{name: "threshold too high", args: config.CircuitBreaker{ErrorRateThreshold: 101}, wantErr: true},
+		{name: "negative window", args: config.CircuitBreaker{ErrorRateThreshold: 5, Window: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newErrorRateWindow(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newErrorRateWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_newRequestLimitBucket(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         config.CircuitBreaker
+		wantNil      bool
+		wantCapacity int64
+		wantRate     float64
+		wantErr      bool
+	}{
+		{name: "no limit", args: config.CircuitBreaker{}, wantNil: true},
+		{name: "total", args: config.CircuitBreaker{RequestLimitCanary: 300}, wantCapacity: 300},
+		{name: "rate per second", args: config.CircuitBreaker{RequestLimitCanary: 10, RequestLimitMode: RequestLimitModeRate}, wantCapacity: 10, wantRate: 10},
+		{name: "rate per minute with burst", args: config.CircuitBreaker{RequestLimitCanary: 600, RequestLimitMode: RequestLimitModeRate, RequestLimitInterval: 60, RequestLimitBurst: 20}, wantCapacity: 20, wantRate: 10},
+		{name: "negative interval", args: config.CircuitBreaker{RequestLimitCanary: 10, RequestLimitMode: RequestLimitModeRate, RequestLimitInterval: -1}, wantErr: true},
+		{name: "unknown mode", args: config.CircuitBreaker{RequestLimitCanary: 10, RequestLimitMode: "lifetime"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newRequestLimitBucket(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newRequestLimitBucket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("newRequestLimitBucket() = %v, wantNil %v", got, tt.wantNil)
+			}
+			if got == nil {
+				return
+			}
+
+			if got.Capacity() != tt.wantCapacity {
+				t.Errorf("newRequestLimitBucket() capacity = %d, want %d", got.Capacity(), tt.wantCapacity)
+			}
+
+			if tt.wantRate != 0 && math.Abs(got.Rate()-tt.wantRate) > 0.01 {
+				t.Errorf("newRequestLimitBucket() rate = %v, want %v", got.Rate(), tt.wantRate)
+			}
+		})
+	}
+}
+
+func Test_errorRateWindow_isTripped(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+
+	type record struct {
+		at       time.Duration
+		requests int
+		errors   int
+	}
+	tests := []struct {
+		name    string
+		records []record
+		at      time.Duration
+		want    bool
+	}{
+		{name: "no request", at: 0, want: false},
+		{name: "below min requests", records: []record{{at: 0, requests: 10, errors: 10}}, at: 0, want: false},
+		{name: "below threshold", records: []record{{at: 0, requests: 100, errors: 5}}, at: 0, want: false},
+		{name: "above threshold", records: []record{{at: 0, requests: 100, errors: 6}}, at: 0, want: true},
+		{name: "spread over the window", records: []record{{at: 0, requests: 50, errors: 3}, {at: 30 * time.Second, requests: 50, errors: 3}}, at: 59 * time.Second, want: true},
+		{name: "early burst slides out of the window", records: []record{{at: 0, requests: 20, errors: 20}, {at: 30 * time.Second, requests: 100, errors: 1}}, at: 60 * time.Second, want: false},
+		{name: "slot reused after a full window", records: []record{{at: 0, requests: 20, errors: 20}, {at: 60 * time.Second, requests: 100, errors: 0}}, at: 60 * time.Second, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := newErrorRateWindow(config.CircuitBreaker{ErrorRateThreshold: 5, MinRequests: 20, Window: 60})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, r := range tt.records {
+				for i := 0; i < r.requests; i++ {
+					w.record(i < r.errors, start.Add(r.at))
+				}
+			}
+
+			if _, got := w.isTripped(start.Add(tt.at)); got != tt.want {
+				t.Errorf("errorRateWindow.isTripped() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_circuitBreaker_halfOpen(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	describe := func(msg string) string { return "Canary " + msg }
+
+	b, err := newCircuitBreaker(config.CircuitBreaker{ErrorLimitCanary: 2, CoolDown: 30, HalfOpenRequests: 2}, nil, describe, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	assertState := func(at time.Duration, wantLimited bool, wantState breakerState) {
+		t.Helper()
+
+		if _, limited := b.limitReason(start.Add(at)); limited != wantLimited {
+			t.Errorf("at %v limitReason() limited = %v, want %v", at, limited, wantLimited)
+		}
+
+		if b.state != wantState {
+			t.Errorf("at %v state = %s, want %s", at, b.state, wantState)
+		}
+	}
+
+	assertState(0, false, breakerClosed)
+
+	b.record(req, true, start)
+	b.record(req, true, start)
+	assertState(0, true, breakerOpen)
+	assertState(29*time.Second, true, breakerOpen)
+	assertState(30*time.Second, false, breakerHalfOpen)
+
+	probe1, ok1 := b.takeProbe(req)
+	probe2, ok2 := b.takeProbe(req)
+	if _, ok3 := b.takeProbe(req); !ok1 || !ok2 || ok3 {
+		t.Fatalf("takeProbe() = %v, %v, %v, want true, true, false", ok1, ok2, ok3)
+	}
+	assertState(30*time.Second, true, breakerHalfOpen)
+
+	// A failed probe re-opens the breaker for another cool-down
+	b.record(probe1, false, start.Add(31*time.Second))
+	b.record(probe2, true, start.Add(31*time.Second))
+	assertState(60*time.Second, true, breakerOpen)
+	assertState(61*time.Second, false, breakerHalfOpen)
+
+	// Successful probes close the breaker, with its error limit reset
+	probe1, _ = b.takeProbe(req)
+	probe2, _ = b.takeProbe(req)
+	b.record(probe1, false, start.Add(62*time.Second))
+	b.record(probe2, false, start.Add(62*time.Second))
+	assertState(62*time.Second, false, breakerClosed)
+
+	b.record(req, true, start.Add(63*time.Second))
+	assertState(63*time.Second, false, breakerClosed)
+}
+
+func Test_circuitBreaker_releaseProbe(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	describe := func(msg string) string { return "Canary " + msg }
+
+	b, err := newCircuitBreaker(config.CircuitBreaker{ErrorLimitCanary: 1, CoolDown: 30}, nil, describe, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	b.record(req, true, start)
+	b.limitReason(start)
+	b.limitReason(start.Add(30 * time.Second))
+
+	probe, ok := b.takeProbe(req)
+	if !ok {
+		t.Fatalf("takeProbe() of a half-open breaker = false, want true")
+	}
+
+	// A request which is not a probe gives nothing back
+	b.releaseProbe(req)
+	if _, ok := b.takeProbe(req); ok {
+		t.Fatalf("takeProbe() = true once all the probes have been taken, want false")
+	}
+
+	b.releaseProbe(probe)
+	if _, ok := b.takeProbe(req); !ok {
+		t.Errorf("takeProbe() = false once the probe has been released, want true")
+	}
+}
+
+func Test_circuitBreaker_peekLimitReason(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	describe := func(msg string) string { return "Canary " + msg }
+
+	b, err := newCircuitBreaker(config.CircuitBreaker{ErrorLimitCanary: 1, CoolDown: 30}, nil, describe, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, limited := b.peekLimitReason(start); limited {
+		t.Errorf("peekLimitReason() of a closed breaker limited = true, want false")
+	}
+
+	b.record(httptest.NewRequest(http.MethodGet, "/", nil), true, start)
+	if _, limited := b.peekLimitReason(start); !limited || b.state != breakerClosed {
+		t.Errorf("peekLimitReason() limited = %v state = %s, want true, %s", limited, b.state, breakerClosed)
+	}
+
+	b.limitReason(start)
+
+	// The cool-down has elapsed, but only a request may move the breaker to half-open
+	if _, limited := b.peekLimitReason(start.Add(time.Minute)); !limited || b.state != breakerOpen {
+		t.Errorf("peekLimitReason() limited = %v state = %s, want true, %s", limited, b.state, breakerOpen)
+	}
+}
+
+func Test_circuitBreaker_withoutCoolDown(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	describe := func(msg string) string { return "Canary " + msg }
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	t.Run("count mode stays open", func(t *testing.T) {
+		b, err := newCircuitBreaker(config.CircuitBreaker{ErrorLimitCanary: 1}, nil, describe, context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.record(req, true, start)
+		if _, limited := b.limitReason(start.Add(24 * time.Hour)); !limited {
+			t.Errorf("limitReason() limited = false, want true")
+		}
+	})
+
+	t.Run("error-rate mode closes once the errors slide out of the window", func(t *testing.T) {
+		b, err := newCircuitBreaker(config.CircuitBreaker{Mode: CircuitBreakerModeErrorRate, ErrorRateThreshold: 50, Window: 60}, nil, describe, context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b.record(req, true, start)
+		if _, limited := b.limitReason(start); !limited {
+			t.Errorf("limitReason() limited = false, want true")
+		}
+
+		if _, limited := b.limitReason(start.Add(time.Minute)); limited || b.state != breakerClosed {
+			t.Errorf("limitReason() limited = %v state = %s, want false closed", limited, b.state)
+		}
+	})
+}
+
+func Test_circuitBreaker_latency(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	describe := func(msg string) string { return "Canary " + msg }
+
+	tests := []struct {
+		name          string
+		args          config.CircuitBreaker
+		canaryLatency time.Duration
+		mainLatency   time.Duration
+		requests      int
+		wantReason    string
+	}{
+		{name: "below threshold", args: config.CircuitBreaker{LatencyThreshold: 500, MinRequests: 10}, canaryLatency: 100 * time.Millisecond, requests: 20, wantReason: ""},
+		{name: "above threshold", args: config.CircuitBreaker{LatencyThreshold: 500, MinRequests: 10}, canaryLatency: time.Second, requests: 20, wantReason: "Canary latency limit reached"},
+		{name: "above threshold below min requests", args: config.CircuitBreaker{LatencyThreshold: 500, MinRequests: 10}, canaryLatency: time.Second, requests: 5, wantReason: ""},
+		{name: "below ratio", args: config.CircuitBreaker{LatencyRatio: 2, MinRequests: 10}, canaryLatency: 150 * time.Millisecond, mainLatency: 100 * time.Millisecond, requests: 20, wantReason: ""},
+		{name: "above ratio", args: config.CircuitBreaker{LatencyRatio: 2, MinRequests: 10}, canaryLatency: 300 * time.Millisecond, mainLatency: 100 * time.Millisecond, requests: 20, wantReason: "Canary latency ratio limit reached"},
+		{name: "above ratio without main requests", args: config.CircuitBreaker{LatencyRatio: 2, MinRequests: 10}, canaryLatency: 300 * time.Millisecond, requests: 20, wantReason: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mainLatencyWindow := newLatencyWindow(60)
+
+			b, err := newCircuitBreaker(tt.args, mainLatencyWindow, describe, context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.requests; i++ {
+				b.recordLatency(tt.canaryLatency, start)
+				if tt.mainLatency != 0 {
+					mainLatencyWindow.record(tt.mainLatency, start)
+				}
+			}
+
+			if gotReason, _ := b.limitReason(start); gotReason != tt.wantReason {
+				t.Errorf("circuitBreaker.limitReason() = %q, want %q", gotReason, tt.wantReason)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package config
 
+import "fmt"
+
 // Config holds the configuration values to be used throughout the application.
 type Config struct {
 	MainTarget       string `mapstructure:"main-target"`
@@ -8,6 +10,34 @@ type Config struct {
 	CanaryHeaderHost string `mapstructure:"canary-header-host"`
 	SidecarURL       string `mapstructure:"sidecar-url"`
 
+	// Targets holds additional canary targets keyed by name, which can be selected by the sidecar
+	// with X-Canary-Target response header. Names are case insensitive, "main" and "canary" are reserved.
+	Targets map[string]Target `mapstructure:"targets"`
+
+	// SidecarURLs if set are several sidecar instances to load balance, instead of SidecarURL
+	SidecarURLs []string `mapstructure:"sidecar-urls"`
+
+	// SidecarBalancer is how the sidecar calls are load balanced across SidecarURLs
+	SidecarBalancer SidecarBalancer `mapstructure:"sidecar-balancer"`
+
+	// SidecarProtocol is how the sidecar returns its decision, either "status-code" (default) or "json"
+	SidecarProtocol string `mapstructure:"sidecar-protocol"`
+
+	// SidecarBody is how much of the request body is sent to the sidecar
+	SidecarBody SidecarBody `mapstructure:"sidecar-body"`
+
+	// SidecarFailure is how requests are routed when the sidecar fails
+	SidecarFailure SidecarFailure `mapstructure:"sidecar-failure"`
+
+	// SidecarBreaker if set skips the sidecar after consecutive failures
+	SidecarBreaker SidecarBreaker `mapstructure:"sidecar-circuit-breaker"`
+
+	// SidecarCache if set will cache the sidecar decisions by request key
+	SidecarCache SidecarCache `mapstructure:"sidecar-cache"`
+
+	// SidecarMutation if set allows the sidecar to mutate the forwarded request with its response headers
+	SidecarMutation SidecarMutation `mapstructure:"sidecar-mutation"`
+
 	// TrimPrefix if set will modify subsequent request path to main, canary, and sidecar service
 	// by removing TrimPrefix substring in the request path string
 	TrimPrefix string `mapstructure:"trim-prefix"`
@@ -20,6 +50,31 @@ type Config struct {
 	// should the route be passed to Canary service.
 	CanarySidecarStatus int `mapstructure:"canary-sidecar-status"`
 
+	// Expression if set is a boolean expression deciding whether the request is routed to canary
+	// service without the need of a sidecar. It is only used when SidecarURL is not provided.
+	Expression string `mapstructure:"expression"`
+
+	// Split if set will route traffic by weight between main and canary service without the
+	// need of a sidecar. It is only used when neither SidecarURL nor Expression is provided.
+	Split Split `mapstructure:"split"`
+
+	// Sticky if set will pin a client to the target it has been routed to, by using a signed cookie
+	Sticky Sticky `mapstructure:"sticky"`
+
+	// Shadow if set will mirror requests served by main service to a canary target, discarding its responses
+	Shadow Shadow `mapstructure:"shadow"`
+
+	// Fallback if enabled will retry the requests against main service when canary service fails
+	Fallback Fallback `mapstructure:"fallback"`
+
+	// Rules is an ordered list of routing rules evaluated before the sidecar is called.
+	// The first matching rule decides the target of the request.
+	Rules []Rule `mapstructure:"rules"`
+
+	// Routes holds route specific configurations dispatched by request host and/or path prefix.
+	// Requests not matching any route are handled by the top level configuration.
+	Routes []Route `mapstructure:"routes"`
+
 	CircuitBreaker  CircuitBreaker        `mapstructure:"circuit-breaker"`
 	Instrumentation InstrumentationConfig `mapstructure:"instrumentation"`
 	Server          HTTPServerConfig      `mapstructure:"router-server"`
@@ -28,6 +83,28 @@ type Config struct {
 	Log Log `mapstructure:"log"`
 }
 
+// Target holds the configuration values of a named canary target.
+type Target struct {
+	URL        string `mapstructure:"url"`
+	HeaderHost string `mapstructure:"header-host"`
+
+	// Client defaults to the proxy-client.to-main-and-canary configuration if it is not set
+	Client         HTTPClientConfig `mapstructure:"client"`
+	CircuitBreaker CircuitBreaker   `mapstructure:"circuit-breaker"`
+}
+
+// Route holds the configuration values of a route. Its routing values (targets, trim prefix, circuit
+// breaker, etc.) default to the top level configuration values when they are not set, except for the
+// routing mode (sidecar, expression or split) which is not inherited if the route sets one. Routes can
+// not be nested.
+type Route struct {
+	Name       string `mapstructure:"name"`
+	Host       string `mapstructure:"host"`
+	PathPrefix string `mapstructure:"path-prefix"`
+
+	Config `mapstructure:",squash"`
+}
+
 // InstrumentationConfig holds the configuration values specific to the instrumentation aspect.
 type InstrumentationConfig struct {
 	Host string `mapstructure:"host"`
@@ -36,8 +113,278 @@ type InstrumentationConfig struct {
 
 // CircuitBreaker holds the configuration values specific to the circuit breaking aspect.
 type CircuitBreaker struct {
+	// Mode is how canary errors trip the circuit breaker, either "count" (default), which uses
+	// ErrorLimitCanary, or "error-rate", which uses ErrorRateThreshold
+	Mode string `mapstructure:"mode"`
+
 	RequestLimitCanary uint64 `mapstructure:"request-limit-canary"`
 	ErrorLimitCanary   uint64 `mapstructure:"error-limit-canary"`
+
+	// RequestLimitMode is how RequestLimitCanary applies, either "total" (default), the number of canary
+	// requests for the process lifetime, or "rate", the number of canary requests per RequestLimitInterval
+	RequestLimitMode string `mapstructure:"request-limit-mode"`
+
+	// RequestLimitInterval is the period (in seconds) RequestLimitCanary applies to in "rate" mode
+	RequestLimitInterval int `mapstructure:"request-limit-interval"`
+
+	// RequestLimitBurst is the maximum number of canary requests at once in "rate" mode, it defaults to
+	// RequestLimitCanary
+	RequestLimitBurst uint64 `mapstructure:"request-limit-burst"`
+
+	// MaxInflightCanary is the maximum number of requests being served by canary at once, any more
+	// than that gets forwarded to main
+	MaxInflightCanary int64 `mapstructure:"max-inflight-canary"`
+
+	// ErrorRateThreshold is the percentage (0-100) of canary errors within Window above which
+	// the circuit breaker trips
+	ErrorRateThreshold float64 `mapstructure:"error-rate-threshold"`
+
+	// MinRequests is the minimum number of canary requests within Window for the error rate and the
+	// latency to be taken into account
+	MinRequests uint64 `mapstructure:"min-requests"`
+
+	// Window is the length (in seconds) of the rolling window the error rate and the latency are computed over
+	Window int `mapstructure:"window"`
+
+	// LatencyPercentile is the percentile (0-100) of the canary latency compared against LatencyThreshold
+	// and LatencyRatio, it defaults to 99
+	LatencyPercentile float64 `mapstructure:"latency-percentile"`
+
+	// LatencyThreshold is the canary latency (in milliseconds) above which the circuit breaker trips
+	LatencyThreshold int `mapstructure:"latency-threshold"`
+
+	// LatencyRatio is the ratio of the canary latency to the main latency above which the circuit breaker trips
+	LatencyRatio float64 `mapstructure:"latency-ratio"`
+
+	// CoolDown is how long (in seconds) the circuit breaker stays open before letting probe requests
+	// through to canary. Without cool-down, it stays open until its error limit is not reached anymore.
+	CoolDown int `mapstructure:"cool-down"`
+
+	// HalfOpenRequests is the number of probe requests which have to succeed for the circuit breaker
+	// to close again
+	HalfOpenRequests int `mapstructure:"half-open-requests"`
+}
+
+// Split holds the configuration values specific to the built-in weighted split aspect.
+type Split struct {
+	// CanaryWeight is the percentage (0-100) of requests which will be forwarded to canary service
+	CanaryWeight *float64 `mapstructure:"canary-weight"`
+
+	// Mode is how the requests are selected, either "random" (default), "deterministic" or "hash"
+	Mode string `mapstructure:"mode"`
+
+	// HashKey is the request key used to bucket requests in "hash" mode
+	HashKey HashKey `mapstructure:"hash-key"`
+
+	// Ramp if set will progressively change CanaryWeight according to its steps
+	Ramp Ramp `mapstructure:"ramp"`
+}
+
+// Ramp holds the configuration values of a progressive rollout schedule.
+type Ramp struct {
+	Steps []RampStep `mapstructure:"steps"`
+
+	// StateFile is where the current step is persisted, so that a restart resumes the ramp
+	// rather than restarts it
+	StateFile string `mapstructure:"state-file"`
+}
+
+// RampStep holds the configuration values of a progressive rollout step.
+type RampStep struct {
+	// CanaryWeight is the percentage (0-100) of requests forwarded to canary service during the step
+	CanaryWeight float64 `mapstructure:"canary-weight"`
+
+	// Duration is how long (in seconds) the step lasts. It is ignored for the last step, which lasts forever.
+	Duration int `mapstructure:"duration"`
+}
+
+// HashKey holds the configuration of the request key used by the "hash" split mode.
+type HashKey struct {
+	// Source is where the key is extracted from, one of "header", "cookie", "query" or "path"
+	Source string `mapstructure:"source"`
+
+	// Name is the header, cookie or query param name. For "path" source, it is the zero based
+	// index of the path segment.
+	Name string `mapstructure:"name"`
+}
+
+// SidecarBalancer holds the configuration values specific to the load balancing across sidecar instances.
+type SidecarBalancer struct {
+	// Mode is how an instance is selected, either "round-robin" (default) or "least-loaded", which selects
+	// the instance with the fewest in-flight calls
+	Mode string `mapstructure:"mode"`
+
+	// MaxAttempts is the maximum number of instances called for a request when the calls fail, 2 by default.
+	// All the attempts share the proxy-client.to-sidecar timeout.
+	MaxAttempts int `mapstructure:"max-attempts"`
+
+	// EjectAfter is the number of consecutive failures ejecting an instance from the selection, 3 by default
+	EjectAfter int `mapstructure:"eject-after"`
+
+	// EjectDuration is how long (in seconds) a failing instance is ejected, 30 by default
+	EjectDuration int `mapstructure:"eject-duration"`
+}
+
+// SidecarBody holds the configuration values specific to the request body sent to the sidecar.
+type SidecarBody struct {
+	// Mode is how much of the request body is sent to the sidecar, either "full" (default), "headers",
+	// which sends no body at all, or "prefix", which sends the first PrefixSize bytes
+	Mode string `mapstructure:"mode"`
+
+	// PrefixSize is the number of bytes sent to the sidecar with the "prefix" mode
+	PrefixSize int64 `mapstructure:"prefix-size"`
+
+	// MaxSize if set is the maximum body size (in bytes) with the "full" mode, larger requests are routed to main
+	MaxSize int64 `mapstructure:"max-size"`
+}
+
+// SidecarFailure holds the configuration values specific to the routing of requests when the sidecar fails.
+type SidecarFailure struct {
+	// Policy is where requests are routed when the sidecar fails (timeout, connection refused, non standard
+	// response, ...), either "main" (default), "canary" or "reject"
+	Policy string `mapstructure:"policy"`
+
+	// StatusCode is the status code of the requests rejected by the "reject" policy, 503 by default
+	StatusCode int `mapstructure:"status-code"`
+}
+
+// SidecarBreaker holds the configuration values specific to the sidecar circuit breaker.
+type SidecarBreaker struct {
+	// FailureThreshold is the number of consecutive sidecar failures opening the breaker, it is disabled if 0
+	FailureThreshold int `mapstructure:"failure-threshold"`
+
+	// CoolDown is how long (in seconds) the sidecar is skipped once the breaker is open, before probing it
+	CoolDown int `mapstructure:"cool-down"`
+}
+
+// SidecarCache holds the configuration values specific to the sidecar decision cache.
+type SidecarCache struct {
+	// Keys are the request values the decisions are cached by. The cache is disabled if it is empty.
+	Keys []HashKey `mapstructure:"keys"`
+
+	// Size is the maximum number of cached decisions, the least recently used ones are evicted
+	Size int `mapstructure:"size"`
+
+	// TTL is how long (in seconds) a decision is cached, unless the sidecar returns a Cache-Control max-age
+	TTL int `mapstructure:"ttl"`
+}
+
+// SidecarMutation holds the configuration values specific to the request mutation instructed by the sidecar.
+type SidecarMutation struct {
+	// Headers is the allowlist of request headers (case insensitive) the sidecar may set or remove
+	Headers []string `mapstructure:"headers"`
+
+	// RewritePath if true allows the sidecar to rewrite the request path
+	RewritePath *bool `mapstructure:"rewrite-path"`
+}
+
+// Shadow holds the configuration values specific to the traffic mirroring aspect.
+type Shadow struct {
+	// SampleRate is the percentage (0-100) of the requests served by main service which are mirrored.
+	// Mirroring is disabled if it is 0.
+	SampleRate *float64 `mapstructure:"sample-rate"`
+
+	// Target is the name of the canary target receiving the mirrored requests, it defaults to "canary"
+	Target string `mapstructure:"target"`
+
+	// Workers is the number of mirrored requests sent concurrently
+	Workers int `mapstructure:"workers"`
+
+	// QueueSize is the number of mirrored requests waiting for a worker, any more than that is dropped
+	QueueSize int `mapstructure:"queue-size"`
+
+	// Diff if enabled will compare the mirrored responses to main service responses
+	Diff ShadowDiff `mapstructure:"diff"`
+}
+
+// ShadowDiff holds the configuration values specific to the mirrored response comparison.
+type ShadowDiff struct {
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Headers are the names of the response headers which are compared
+	Headers []string `mapstructure:"headers"`
+
+	// IgnoredFields are the dot separated paths of the JSON body fields which are not compared,
+	// e.g. "data.updatedAt". A "*" path segment matches any object key or array index.
+	IgnoredFields []string `mapstructure:"ignored-fields"`
+
+	// MaxBodySize is the maximum size (in bytes) of the compared bodies, larger bodies are not compared
+	MaxBodySize int `mapstructure:"max-body-size"`
+
+	// LogFile is where the mismatch samples are written as JSON lines. They are logged if it is not set.
+	LogFile string `mapstructure:"log-file"`
+
+	// LogPerMinute is the maximum number of mismatch samples written per minute
+	LogPerMinute int `mapstructure:"log-per-minute"`
+}
+
+// Fallback holds the configuration values specific to the canary failure fallback aspect.
+type Fallback struct {
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Methods are the request methods which are retried, it defaults to GET, HEAD, PUT and DELETE
+	Methods []string `mapstructure:"methods"`
+
+	// StatusCodes are the canary response status codes which are retried, besides connection errors
+	StatusCodes []int `mapstructure:"status-codes"`
+}
+
+// Sticky holds the configuration values specific to the routing affinity aspect.
+type Sticky struct {
+	// SigningKey is the secret used to sign the affinity cookie. Affinity is disabled if it is empty.
+	SigningKey string `mapstructure:"signing-key"`
+
+	// CookieName is the name of the affinity cookie
+	CookieName string `mapstructure:"cookie-name"`
+
+	// TTL is how long (in seconds) a client stays pinned to its target
+	TTL int `mapstructure:"ttl"`
+}
+
+// String implements fmt.Stringer, masking the signing key so that it is not logged
+func (s Sticky) String() string {
+	signingKey := ""
+	if s.SigningKey != "" {
+		signingKey = "******"
+	}
+
+	return fmt.Sprintf("{SigningKey:%s CookieName:%s TTL:%d}", signingKey, s.CookieName, s.TTL)
+}
+
+// Rule holds the configuration of a routing rule. A rule matches a request when all of its
+// provided matchers match.
+type Rule struct {
+	Name string `mapstructure:"name"`
+
+	// Target is where the matching request is forwarded, one of "main", "canary" or "sidecar"
+	Target string `mapstructure:"target"`
+
+	Methods []string       `mapstructure:"methods"`
+	Host    string         `mapstructure:"host"`
+	Path    PathMatcher    `mapstructure:"path"`
+	Headers []ValueMatcher `mapstructure:"headers"`
+	Query   []ValueMatcher `mapstructure:"query"`
+	Cookies []ValueMatcher `mapstructure:"cookies"`
+}
+
+// PathMatcher holds the configuration of a request path matcher. Only one of its fields should be set.
+type PathMatcher struct {
+	Prefix string `mapstructure:"prefix"`
+	Glob   string `mapstructure:"glob"`
+	Regex  string `mapstructure:"regex"`
+}
+
+// ValueMatcher holds the configuration of a named request value (header, query param or cookie) matcher.
+// The value has to be present, and to satisfy all of the provided conditions.
+type ValueMatcher struct {
+	Name   string `mapstructure:"name"`
+	Equals string `mapstructure:"equals"`
+	Prefix string `mapstructure:"prefix"`
+	Regex  string `mapstructure:"regex"`
+
+	// GreaterOrEqual and LessOrEqual compare the value as a number
+	GreaterOrEqual *float64 `mapstructure:"gte"`
+	LessOrEqual    *float64 `mapstructure:"lte"`
 }
 
 // HTTPServerConfig holds the configuration for instantiating http.Server
@@ -75,3 +422,13 @@ type Log struct {
 	DebugRequestBody  bool   `mapstructure:"debug-request-body"`
 	DebugResponseBody bool   `mapstructure:"debug-response-body"`
 }
+
+// Bool returns a pointer to b, for the optional boolean configuration values which a route may set to false
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Float64 returns a pointer to f, for the optional number configuration values which a route may set to 0
+func Float64(f float64) *float64 {
+	return &f
+}
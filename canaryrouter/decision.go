@@ -0,0 +1,234 @@
+package canaryrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SidecarProtocolStatusCode is the default sidecar protocol, the decision is the response status code:
+	// StatusCodeMain or StatusCodeCanary, along with the HeaderCanaryTarget and request mutation headers
+	SidecarProtocolStatusCode = "status-code"
+
+	// SidecarProtocolJSON is the sidecar protocol where the decision is the SidecarResponse JSON body
+	// of a 200 response
+	SidecarProtocolJSON = "json"
+)
+
+// SidecarResponse is the decision returned by the sidecar as JSON body with SidecarProtocolJSON
+type SidecarResponse struct {
+	// Target is the name of the target the request is forwarded to, "main", "canary" or the name of
+	// another canary target
+	Target string `json:"target"`
+
+	// Reason explains the decision, it is reported as the reason tag of the metrics so it should only
+	// take a few distinct values
+	Reason string `json:"reason,omitempty"`
+
+	// CacheTTL is how long (in seconds) the decision may be cached by the sidecar cache, 0 prevents caching.
+	// The sidecar cache ttl is used if it is absent.
+	CacheTTL *int `json:"cache-ttl,omitempty"`
+
+	// SetHeaders are the request headers to set before forwarding the request
+	SetHeaders map[string]string `json:"set-headers,omitempty"`
+
+	// RemoveHeaders are the request headers to remove before forwarding the request
+	RemoveHeaders []string `json:"remove-headers,omitempty"`
+
+	// RewritePath if set rewrites the request path before forwarding the request
+	RewritePath string `json:"rewrite-path,omitempty"`
+}
+
+// Decider returns the routing decision for a request. The sidecar is a Decider, another one can be provided
+// with WithDecider to route the requests in-process. A Decider must be safe for concurrent use, and must
+// restore the request body if it reads it, as the request is forwarded afterwards.
+type Decider interface {
+	Decide(req *http.Request) (*Decision, error)
+}
+
+// DeciderFunc is a function used as a Decider
+type DeciderFunc func(req *http.Request) (*Decision, error)
+
+// Decide calls f(req)
+func (f DeciderFunc) Decide(req *http.Request) (*Decision, error) {
+	return f(req)
+}
+
+// Decision is the routing decision of a Decider
+type Decision struct {
+	// Target is either TargetMain or the name of a canary target
+	Target string
+
+	// Reason explains the decision, it is reported as the reason tag of the metrics so it should only
+	// take a few distinct values
+	Reason string
+
+	// TTL is how long the decision may be cached by the sidecar cache, 0 for the sidecar cache ttl and
+	// negative if it may not be cached
+	TTL time.Duration
+
+	// SetHeaders are the request headers to set before forwarding the request
+	SetHeaders http.Header
+
+	// RemoveHeaders are the request headers to remove before forwarding the request
+	RemoveHeaders []string
+
+	// RewritePath if set rewrites the request path before forwarding the request
+	RewritePath string
+}
+
+// decoder decodes the sidecar response into a decision
+type decoder func(statusCode int, header http.Header, body []byte) (*Decision, error)
+
+func newDecoder(protocol string) (decoder, error) {
+	switch strings.ToLower(protocol) {
+	case "", SidecarProtocolStatusCode:
+		return decodeStatusCode, nil
+	case SidecarProtocolJSON:
+		return decodeJSON, nil
+	default:
+		return nil, errors.Errorf("sidecar-protocol %q is not recognized", protocol)
+	}
+}
+
+// decodeStatusCode decodes a decision of SidecarProtocolStatusCode
+func decodeStatusCode(statusCode int, header http.Header, body []byte) (*Decision, error) {
+	d := &Decision{
+		Reason:      fmt.Sprintf("Sidecar returns status code %d", statusCode),
+		TTL:         cacheControlTTL(header),
+		SetHeaders:  make(http.Header),
+		RewritePath: header.Get(HeaderRewritePath),
+	}
+
+	switch statusCode {
+	case StatusCodeMain:
+		d.Target = TargetMain
+	case StatusCodeCanary:
+		d.Target = strings.ToLower(header.Get(HeaderCanaryTarget))
+		if d.Target == "" {
+			d.Target = TargetCanary
+		}
+	default:
+		return nil, newSidecarError(sidecarReasonBadStatus, errors.Errorf("Sidecar returns non standard status code %d", statusCode))
+	}
+
+	for _, names := range header[HeaderRemoveHeader] {
+		for _, name := range strings.Split(names, ",") {
+			d.RemoveHeaders = append(d.RemoveHeaders, strings.TrimSpace(name))
+		}
+	}
+
+	for _, field := range header[HeaderSetHeader] {
+		i := strings.Index(field, ":")
+		if i < 0 {
+			log.Warnf("Ignoring malformed %s sidecar header %q", HeaderSetHeader, field)
+			continue
+		}
+		d.SetHeaders.Set(strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:]))
+	}
+
+	return d, nil
+}
+
+// decodeJSON decodes a decision of SidecarProtocolJSON
+func decodeJSON(statusCode int, header http.Header, body []byte) (*Decision, error) {
+	if statusCode != http.StatusOK {
+		return nil, newSidecarError(sidecarReasonBadStatus, errors.Errorf("Sidecar returns non standard status code %d", statusCode))
+	}
+
+	var resp SidecarResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, newSidecarError(sidecarReasonBadResponse, errors.Errorf("Sidecar returns malformed JSON decision: %v", err))
+	}
+
+	return resp.decision(cacheControlTTL(header))
+}
+
+// decision converts the sidecar response into a decision, ttl being the decision ttl when CacheTTL is absent
+func (resp SidecarResponse) decision(ttl time.Duration) (*Decision, error) {
+	if resp.Target == "" {
+		return nil, newSidecarError(sidecarReasonBadResponse, errors.New("Sidecar returns no target"))
+	}
+
+	d := &Decision{
+		Target:        strings.ToLower(resp.Target),
+		Reason:        fmt.Sprintf("Sidecar selects %s", strings.ToLower(resp.Target)),
+		TTL:           ttl,
+		SetHeaders:    make(http.Header, len(resp.SetHeaders)),
+		RemoveHeaders: resp.RemoveHeaders,
+		RewritePath:   resp.RewritePath,
+	}
+
+	if resp.Reason != "" {
+		d.Reason = fmt.Sprintf("%s (%s)", d.Reason, resp.Reason)
+	}
+
+	if resp.CacheTTL != nil {
+		d.TTL = time.Duration(*resp.CacheTTL) * time.Second
+		if *resp.CacheTTL <= 0 {
+			d.TTL = -1
+		}
+	}
+
+	for name, value := range resp.SetHeaders {
+		d.SetHeaders.Set(name, value)
+	}
+
+	return d, nil
+}
+
+// cacheControlTTL returns how long a sidecar response may be cached according to its Cache-Control header,
+// 0 if it is not specified and negative if it may not be cached
+func cacheControlTTL(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return -1
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || maxAge <= 0 {
+				return -1
+			}
+			return time.Duration(maxAge) * time.Second
+		}
+	}
+
+	return 0
+}
+
+// decide returns the routing decision of the sidecar for the request, from the sidecar cache if it is enabled
+func (s *Server) decide(req *http.Request) (*Decision, error) {
+	if !s.isSidecarCacheEnabled() {
+		return s.sidecar.Decide(req)
+	}
+
+	key, ok := s.sidecarCache.key(req)
+	if !ok {
+		return s.sidecar.Decide(req)
+	}
+
+	if d, ok := s.sidecarCache.get(key, time.Now()); ok {
+		s.recordSidecarCache(req, sidecarCacheHit)
+		return d, nil
+	}
+
+	s.recordSidecarCache(req, sidecarCacheMiss)
+
+	d, err := s.sidecar.Decide(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sidecarCache.set(key, d, time.Now())
+
+	return d, nil
+}
@@ -0,0 +1,158 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_newDecoder(t *testing.T) {
+	tests := []struct {
+		protocol string
+		wantErr  bool
+	}{
+		{protocol: "", wantErr: false},
+		{protocol: "status-code", wantErr: false},
+		{protocol: "JSON", wantErr: false},
+		{protocol: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.protocol), func(t *testing.T) {
+			_, err := newDecoder(tt.protocol)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newDecoder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_decodeStatusCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		header     http.Header
+		want       *Decision
+		wantErr    bool
+	}{
+		{
+			name:       "main",
+			statusCode: StatusCodeMain,
+			header:     http.Header{},
+			want:       &Decision{Target: TargetMain, Reason: "Sidecar returns status code 204", SetHeaders: http.Header{}},
+		},
+		{
+			name:       "default canary",
+			statusCode: StatusCodeCanary,
+			header:     http.Header{"Cache-Control": {"max-age=5"}},
+			want:       &Decision{Target: TargetCanary, Reason: "Sidecar returns status code 200", TTL: 5 * time.Second, SetHeaders: http.Header{}},
+		},
+		{
+			name:       "named canary with mutations",
+			statusCode: StatusCodeCanary,
+			header: http.Header{
+				HeaderCanaryTarget: {"Beta"},
+				HeaderSetHeader:    {"x-tenant-id: 42", "malformed"},
+				HeaderRemoveHeader: {"X-Debug, X-Trace", "X-Foo"},
+				HeaderRewritePath:  {"/v2"},
+			},
+			want: &Decision{
+				Target:        "beta",
+				Reason:        "Sidecar returns status code 200",
+				SetHeaders:    http.Header{"X-Tenant-Id": {"42"}},
+				RemoveHeaders: []string{"X-Debug", "X-Trace", "X-Foo"},
+				RewritePath:   "/v2",
+			},
+		},
+		{name: "non standard status code", statusCode: http.StatusInternalServerError, header: http.Header{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeStatusCode(tt.statusCode, tt.header, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeStatusCode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeStatusCode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		want       *Decision
+		wantErr    bool
+	}{
+		{
+			name:       "main",
+			statusCode: http.StatusOK,
+			body:       `{"target": "main"}`,
+			want:       &Decision{Target: TargetMain, Reason: "Sidecar selects main", SetHeaders: http.Header{}},
+		},
+		{
+			name:       "canary with everything",
+			statusCode: http.StatusOK,
+			body: `{"target": "Beta", "reason": "beta tester", "cache-ttl": 30, "set-headers": {"x-tenant-id": "42"},
+				"remove-headers": ["X-Debug"], "rewrite-path": "/v2"}`,
+			want: &Decision{
+				Target:        "beta",
+				Reason:        "Sidecar selects beta (beta tester)",
+				TTL:           30 * time.Second,
+				SetHeaders:    http.Header{"X-Tenant-Id": {"42"}},
+				RemoveHeaders: []string{"X-Debug"},
+				RewritePath:   "/v2",
+			},
+		},
+		{
+			name:       "not cached",
+			statusCode: http.StatusOK,
+			body:       `{"target": "canary", "cache-ttl": 0}`,
+			want:       &Decision{Target: TargetCanary, Reason: "Sidecar selects canary", TTL: -1, SetHeaders: http.Header{}},
+		},
+		{name: "no target", statusCode: http.StatusOK, body: `{"reason": "foo"}`, wantErr: true},
+		{name: "malformed", statusCode: http.StatusOK, body: `canary`, wantErr: true},
+		{name: "status code protocol", statusCode: StatusCodeMain, body: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeJSON(tt.statusCode, http.Header{}, []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeJSON() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cacheControlTTL(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         time.Duration
+	}{
+		{cacheControl: "", want: 0},
+		{cacheControl: "public", want: 0},
+		{cacheControl: "max-age=5", want: 5 * time.Second},
+		{cacheControl: "public, Max-Age=5", want: 5 * time.Second},
+		{cacheControl: "max-age=0", want: -1},
+		{cacheControl: "max-age=foo", want: -1},
+		{cacheControl: "no-store", want: -1},
+		{cacheControl: "no-cache, max-age=5", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Quote(tt.cacheControl), func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Cache-Control", tt.cacheControl)
+
+			if got := cacheControlTTL(header); got != tt.want {
+				t.Errorf("cacheControlTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package canaryrouter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/vm"
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// expression is a compiled boolean routing predicate. A request is forwarded to canary when it
+// evaluates to true, and to main otherwise.
+type expression struct {
+	source  string
+	program *vm.Program
+}
+
+func newExpression(source string) (*expression, error) {
+	program, err := expr.Compile(source, expr.Env(expressionEnv(nil, time.Time{})), expr.AsBool())
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid expression %q", source)
+	}
+
+	return &expression{source: source, program: program}, nil
+}
+
+// expressionEnv provides the variables and functions available to the expression.
+// A nil request is used at compile time for type checking.
+func expressionEnv(req *http.Request, now time.Time) map[string]interface{} {
+	env := map[string]interface{}{
+		"method":   "",
+		"path":     "",
+		"host":     "",
+		"clientIP": "",
+		"headers":  map[string]string{},
+		"cookies":  map[string]string{},
+		"query":    map[string]string{},
+		"hour":     now.Hour(),
+		"minute":   now.Minute(),
+		"weekday":  now.Weekday().String(),
+		"number":   toNumber,
+	}
+
+	if req == nil {
+		return env
+	}
+
+	env["method"] = req.Method
+	env["path"] = req.URL.Path
+	env["host"] = requestHostname(req)
+	env["clientIP"] = clientIP(req)
+
+	headers := make(map[string]string, len(req.Header))
+	for name := range req.Header {
+		headers[name] = req.Header.Get(name)
+	}
+	env["headers"] = headers
+
+	cookies := make(map[string]string)
+	for _, cookie := range req.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	env["cookies"] = cookies
+
+	query := make(map[string]string)
+	for name, values := range req.URL.Query() {
+		query[name] = values[0]
+	}
+	env["query"] = query
+
+	return env
+}
+
+// toNumber converts a string value to a number, it returns 0 if the value is not a number
+func toNumber(value string) float64 {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+
+	return number
+}
+
+// clientIP returns the left-most X-Forwarded-For address if it is present, or the request remote address otherwise
+func clientIP(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+
+	return req.RemoteAddr
+}
+
+// toCanary evaluates the expression against the request
+func (e *expression) toCanary(req *http.Request, now time.Time) (bool, error) {
+	output, err := expr.Run(e.program, expressionEnv(req, now))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	toCanary, ok := output.(bool)
+	if !ok {
+		return false, errors.Errorf("expression returns %T instead of bool", output)
+	}
+
+	return toCanary, nil
+}
+
+func (s *Server) isExpressionProvided() bool {
+	return s.expression != nil
+}
+
+func (s *Server) viaProxyWithExpression() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if reason, limited := s.defaultCanary().limitReason(); limited {
+			req = setRoutingReason(req, reason)
+
+			s.serveMain(w, req)
+			return
+		}
+
+		toCanary, err := s.expression.toCanary(req, time.Now())
+		if err != nil {
+			req = setRoutingReason(req, "Expression evaluation error")
+			log.Print(fmt.Errorf("Error when evaluating expression: %v", err))
+
+			s.serveMain(w, req)
+			return
+		}
+
+		req = markAffinityEligible(req)
+
+		if !toCanary {
+			req = setRoutingReason(req, "Expression selects main")
+			s.serveMain(w, req)
+			return
+		}
+
+		s.serveCanaryWithinLimit(w, req, s.defaultCanary(), "Expression selects canary")
+	}
+}
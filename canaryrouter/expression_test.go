@@ -0,0 +1,71 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_newExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		wantErr bool
+	}{
+		{name: "valid", args: `method == "POST" && path startsWith "/orders/"`, wantErr: false},
+		{name: "syntax error", args: `method == `, wantErr: true},
+		{name: "unknown variable", args: `userAgent == "curl"`, wantErr: true},
+		{name: "non boolean", args: `hour + 1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newExpression(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newExpression() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_expression_toCanary(t *testing.T) {
+	noon := time.Date(2019, time.September, 2, 12, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name  string
+		args  string
+		setup func(req *http.Request)
+		want  bool
+	}{
+		{name: "method and path", args: `method == "POST" && path startsWith "/orders/"`, setup: func(req *http.Request) {}, want: true},
+		{name: "header as number", args: `number(headers["X-App-Version"]) >= 5`, setup: func(req *http.Request) { req.Header.Set("x-app-version", "5.1") }, want: true},
+		{name: "missing header", args: `headers["X-App-Version"] == "5"`, setup: func(req *http.Request) {}, want: false},
+		{name: "cookie", args: `cookies["tier"] in ["gold", "platinum"]`, setup: func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "tier", Value: "gold"}) }, want: true},
+		{name: "query", args: `query["beta"] == "1"`, setup: func(req *http.Request) { req.URL.RawQuery = "beta=1" }, want: true},
+		{name: "client IP from remote address", args: `clientIP == "10.0.0.1"`, setup: func(req *http.Request) { req.RemoteAddr = "10.0.0.1:4567" }, want: true},
+		{name: "client IP from X-Forwarded-For", args: `clientIP startsWith "192.168."`, setup: func(req *http.Request) { req.Header.Set("X-Forwarded-For", "192.168.1.1, 10.0.0.1") }, want: true},
+		{name: "time of day", args: `hour >= 9 && hour < 17 && weekday != "Sunday"`, setup: func(req *http.Request) {}, want: true},
+		{name: "host", args: `host == "api.example.com"`, setup: func(req *http.Request) {}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newExpression(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "http://api.example.com:8080/orders/42", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(req)
+
+			got, err := e.toCanary(req, noon)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("toCanary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
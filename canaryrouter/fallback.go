@@ -0,0 +1,176 @@
+package canaryrouter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+// defaultFallbackMethods are the idempotent methods retried against main by default
+var defaultFallbackMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+
+// fallback retries the requests against main when canary fails
+type fallback struct {
+	methods     map[string]bool
+	statusCodes map[int]bool
+}
+
+func newFallback(fallbackConfig config.Fallback) (*fallback, error) {
+	f := &fallback{
+		methods:     make(map[string]bool),
+		statusCodes: make(map[int]bool),
+	}
+
+	methods := fallbackConfig.Methods
+	if len(methods) == 0 {
+		methods = defaultFallbackMethods
+	}
+	for _, method := range methods {
+		f.methods[strings.ToUpper(method)] = true
+	}
+
+	for _, statusCode := range fallbackConfig.StatusCodes {
+		if statusCode < 100 || statusCode > 599 {
+			return nil, errors.Errorf("fallback status code %d is not valid", statusCode)
+		}
+		f.statusCodes[statusCode] = true
+	}
+
+	return f, nil
+}
+
+// fallbackWriter holds the canary response back until its status code is known. The response is
+// discarded if canary fails, so that the request can be retried against main.
+type fallbackWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	statusCodes map[int]bool
+
+	committed bool
+	failed    bool
+	reason    string
+}
+
+func newFallbackWriter(w http.ResponseWriter, statusCodes map[int]bool) *fallbackWriter {
+	return &fallbackWriter{w: w, header: make(http.Header), statusCodes: statusCodes}
+}
+
+func (f *fallbackWriter) Header() http.Header {
+	if f.committed {
+		return f.w.Header()
+	}
+
+	return f.header
+}
+
+func (f *fallbackWriter) WriteHeader(statusCode int) {
+	if f.failed {
+		return
+	}
+
+	if f.committed {
+		f.w.WriteHeader(statusCode)
+		return
+	}
+
+	if f.statusCodes[statusCode] {
+		f.failed = true
+		f.reason = fmt.Sprintf("returns status code %d", statusCode)
+		return
+	}
+
+	for name, values := range f.header {
+		f.w.Header()[name] = values
+	}
+
+	f.committed = true
+	f.w.WriteHeader(statusCode)
+}
+
+func (f *fallbackWriter) Write(b []byte) (int, error) {
+	if !f.committed && !f.failed {
+		f.WriteHeader(http.StatusOK)
+	}
+
+	if f.failed {
+		return len(b), nil
+	}
+
+	return f.w.Write(b)
+}
+
+// Flush implements http.Flusher. Nothing is flushed until the canary response is committed, as it may
+// still be discarded for the fallback to main.
+func (f *fallbackWriter) Flush() {
+	if !f.committed {
+		return
+	}
+
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// proxyError marks the canary response as failed, it returns false if the response has already
+// been written to the client
+func (f *fallbackWriter) proxyError() bool {
+	if f.committed {
+		return false
+	}
+
+	f.failed = true
+	f.reason = "connection error"
+
+	return true
+}
+
+// isFallbackEligible returns whether the request may be retried against main. Upgrade requests are not,
+// as their connection is hijacked by the proxy, which the buffered fallbackWriter does not support.
+func (s *Server) isFallbackEligible(req *http.Request) bool {
+	return s.fallback != nil && s.fallback.methods[req.Method] && !isUpgradeRequest(req)
+}
+
+// serveCanaryWithFallback forwards request to the canary target, and retries it against main if canary
+// fails with a connection error or with one of the fallback status codes
+func (s *Server) serveCanaryWithFallback(w http.ResponseWriter, req *http.Request, target *canaryTarget) {
+	// Buffer the body so that the request can be sent twice
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Printf("Failed to read request body: %v", err)
+			target.releaseRequest(req)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if log.IsLevelEnabled(log.DebugLevel) {
+		s.logRequest(target.name, req)
+	}
+
+	fw := newFallbackWriter(w, s.fallback.statusCodes)
+	s.pinAffinity(fw, req, target.name)
+	target.proxy.ServeHTTP(fw, s.mutatedRequest(req))
+	target.recordLatency(req.Context())
+
+	if !fw.failed {
+		s.recordMetricTarget(req.Context(), target.name)
+		return
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req = setRoutingReason(req, target.describe(fw.reason+", fallback to main"))
+	// NOTE: The client must not be pinned to main because of a canary failure, and the request must not be
+	// mirrored, as it has already been sent to canary
+	req = clearAffinityEligible(req)
+	s.forwardMain(w, req, false)
+}
@@ -16,7 +16,37 @@ var (
 	// MLatencyMs records the time it took for request to be served (routed to proxy)
 	MLatencyMs = stats.Float64("request/latency", "Latency of request served", "ms")
 
-	// KeyTarget holds target information of the request being routed. It will be either "canary" or "main"
+	// MRampStep records the current step (zero based) of the progressive rollout ramp
+	MRampStep = stats.Int64("ramp/step", "Current step of the ramp", stats.UnitDimensionless)
+
+	// MRampNextTransition records the time of the next ramp transition, or 0 if the current step is the last one
+	MRampNextTransition = stats.Int64("ramp/next_transition", "Unix time of the next ramp step transition", "s")
+
+	// MCircuitBreakerState records the state of a canary target circuit breaker, 0 for closed, 1 for open
+	// and 2 for half-open
+	MCircuitBreakerState = stats.Int64("circuit_breaker/state", "State of the canary circuit breaker", stats.UnitDimensionless)
+
+	// MCanaryRequestBudget records the number of requests a canary target may still receive before
+	// reaching its request limit
+	MCanaryRequestBudget = stats.Int64("circuit_breaker/request_budget", "Remaining canary request limit", stats.UnitDimensionless)
+
+	// MCanaryInflight records the number of requests being served by a canary target
+	MCanaryInflight = stats.Int64("canary/inflight", "In-flight canary requests", stats.UnitDimensionless)
+
+	// MShadowCount records a mirrored request, including the dropped ones
+	MShadowCount = stats.Int64("shadow/count", "Mirrored requests", stats.UnitDimensionless)
+
+	// MShadowLatencyMs records the time it took for a mirrored request to be served by canary
+	MShadowLatencyMs = stats.Float64("shadow/latency", "Latency of mirrored request", "ms")
+
+	// MShadowDiffCount records the comparison of a mirrored response to main response
+	MShadowDiffCount = stats.Int64("shadow/diff", "Mirrored responses compared to main", stats.UnitDimensionless)
+
+	// MSidecarCacheCount records a sidecar decision cache lookup
+	MSidecarCacheCount = stats.Int64("sidecar_cache/count", "Sidecar decision cache lookups", stats.UnitDimensionless)
+
+	// KeyTarget holds target information of the request being routed. It will be either "main", "canary"
+	// or the name of another canary target
 	KeyTarget, _ = tag.NewKey("target")
 
 	// KeyReason holds information of the reason on routing decision
@@ -24,6 +54,20 @@ var (
 
 	// KeyVersion holds information of binary version
 	KeyVersion, _ = tag.NewKey("version")
+
+	// KeyRoute holds the name of the route handling the request
+	KeyRoute, _ = tag.NewKey("route")
+
+	// KeyStatus holds the status code returned for a mirrored request, "error" if it failed or "dropped"
+	// if the mirroring queue was full
+	KeyStatus, _ = tag.NewKey("status")
+
+	// KeyCacheResult holds the result of a sidecar decision cache lookup, either "hit" or "miss"
+	KeyCacheResult, _ = tag.NewKey("result")
+
+	// KeyMismatch holds the first difference found between a mirrored response and main response, either
+	// "status", "header" or "body", or "none" if they match
+	KeyMismatch, _ = tag.NewKey("mismatch")
 )
 
 func sinceInMilliseconds(startTime time.Time) float64 {
@@ -43,6 +87,62 @@ func RecordLatency(ctx context.Context) {
 	}
 }
 
+// Latency returns the time elapsed since InitializeLatencyTracking, it returns false if the latency
+// is not tracked
+func Latency(ctx context.Context) (time.Duration, bool) {
+	startTime, ok := ctx.Value(startTimeKey).(time.Time)
+	if !ok {
+		return 0, false
+	}
+
+	return time.Since(startTime), true
+}
+
+// RecordRampStep ...
+func RecordRampStep(ctx context.Context, step int, nextTransition time.Time) {
+	var nextTransitionUnix int64
+	if !nextTransition.IsZero() {
+		nextTransitionUnix = nextTransition.Unix()
+	}
+
+	stats.Record(ctx, MRampStep.M(int64(step)), MRampNextTransition.M(nextTransitionUnix))
+}
+
+// RecordCircuitBreakerState ...
+func RecordCircuitBreakerState(ctx context.Context, state int) {
+	stats.Record(ctx, MCircuitBreakerState.M(int64(state)))
+}
+
+// RecordCanaryRequestBudget ...
+func RecordCanaryRequestBudget(ctx context.Context, budget int64) {
+	stats.Record(ctx, MCanaryRequestBudget.M(budget))
+}
+
+// RecordCanaryInflight ...
+func RecordCanaryInflight(ctx context.Context, inflight int64) {
+	stats.Record(ctx, MCanaryInflight.M(inflight))
+}
+
+// RecordShadowDropped ...
+func RecordShadowDropped(ctx context.Context) {
+	stats.Record(ctx, MShadowCount.M(1))
+}
+
+// RecordShadowLatency ...
+func RecordShadowLatency(ctx context.Context, latency time.Duration) {
+	stats.Record(ctx, MShadowCount.M(1), MShadowLatencyMs.M(float64(latency.Nanoseconds())/1e6))
+}
+
+// RecordShadowDiff ...
+func RecordShadowDiff(ctx context.Context) {
+	stats.Record(ctx, MShadowDiffCount.M(1))
+}
+
+// RecordSidecarCache ...
+func RecordSidecarCache(ctx context.Context) {
+	stats.Record(ctx, MSidecarCacheCount.M(1))
+}
+
 // AddTargetTag ...
 func AddTargetTag(ctx context.Context, target string) (context.Context, error) {
 	return tag.New(ctx, tag.Upsert(KeyTarget, target))
@@ -53,7 +153,27 @@ func AddReasonTag(ctx context.Context, reason string) (context.Context, error) {
 	return tag.New(ctx, tag.Upsert(KeyReason, reason))
 }
 
+// AddRouteTag ...
+func AddRouteTag(ctx context.Context, route string) (context.Context, error) {
+	return tag.New(ctx, tag.Upsert(KeyRoute, route))
+}
+
 // AddVersionTag ...
 func AddVersionTag(ctx context.Context, version string) (context.Context, error) {
 	return tag.New(ctx, tag.Upsert(KeyVersion, version))
 }
+
+// AddStatusTag ...
+func AddStatusTag(ctx context.Context, status string) (context.Context, error) {
+	return tag.New(ctx, tag.Upsert(KeyStatus, status))
+}
+
+// AddMismatchTag ...
+func AddMismatchTag(ctx context.Context, mismatch string) (context.Context, error) {
+	return tag.New(ctx, tag.Upsert(KeyMismatch, mismatch))
+}
+
+// AddCacheResultTag ...
+func AddCacheResultTag(ctx context.Context, result string) (context.Context, error) {
+	return tag.New(ctx, tag.Upsert(KeyCacheResult, result))
+}
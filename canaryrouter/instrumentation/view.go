@@ -21,7 +21,7 @@ var (
 		Measure:     MLatencyMs,
 		Description: "The count of requests per target and reason",
 		Aggregation: view.Count(),
-		TagKeys:     []tag.Key{KeyVersion, KeyTarget, KeyReason},
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget, KeyReason},
 	}
 
 	// RequestLatencyView provide view for latency count distribution
@@ -33,10 +33,91 @@ var (
 		// Latency in buckets:
 		// [>=0ms, >=25ms, >=50ms, >=75ms, >=100ms, >=200ms, >=400ms, >=600ms, >=800ms, >=1s, >=2s, >=4s, >=6s]
 		Aggregation: view.Distribution(0, 25, 50, 75, 100, 200, 400, 600, 800, 1000, 2000, 4000, 6000),
-		TagKeys:     []tag.Key{KeyVersion, KeyTarget},
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget},
 	}
 
-	views = []*view.View{RequestCountView, RequestLatencyView}
+	// RampStepView provide view for the current step of the progressive rollout ramp
+	RampStepView = &view.View{
+		Name:        "ramp/step",
+		Measure:     MRampStep,
+		Description: "The current step of the ramp per route",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute},
+	}
+
+	// RampNextTransitionView provide view for the time of the next ramp step transition
+	RampNextTransitionView = &view.View{
+		Name:        "ramp/next_transition",
+		Measure:     MRampNextTransition,
+		Description: "The unix time of the next ramp step transition per route, 0 on the last step",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute},
+	}
+
+	// CircuitBreakerStateView provide view for the state of the canary target circuit breakers
+	CircuitBreakerStateView = &view.View{
+		Name:        "circuit_breaker/state",
+		Measure:     MCircuitBreakerState,
+		Description: "The state of the circuit breaker per route and canary target (or sidecar), 0 closed, 1 open, 2 half-open",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget},
+	}
+
+	// CanaryRequestBudgetView provide view for the remaining request limit of the canary targets
+	CanaryRequestBudgetView = &view.View{
+		Name:        "circuit_breaker/request_budget",
+		Measure:     MCanaryRequestBudget,
+		Description: "The number of requests a canary target may still receive per route and canary target",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget},
+	}
+
+	// CanaryInflightView provide view for the number of requests being served by the canary targets
+	CanaryInflightView = &view.View{
+		Name:        "canary/inflight",
+		Measure:     MCanaryInflight,
+		Description: "The number of in-flight requests per route and canary target",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget},
+	}
+
+	// ShadowCountView provide view for mirrored request count grouped by target and status
+	ShadowCountView = &view.View{
+		Name:        "shadow/count",
+		Measure:     MShadowCount,
+		Description: "The count of mirrored requests per route, target and status",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget, KeyStatus},
+	}
+
+	// ShadowLatencyView provide view for mirrored request latency distribution
+	ShadowLatencyView = &view.View{
+		Name:        "shadow/latency",
+		Measure:     MShadowLatencyMs,
+		Description: "The latency distribution of mirrored requests per route and target",
+		Aggregation: view.Distribution(0, 25, 50, 75, 100, 200, 400, 600, 800, 1000, 2000, 4000, 6000),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget},
+	}
+
+	// ShadowDiffView provide view for mirrored response comparison count grouped by target and mismatch
+	ShadowDiffView = &view.View{
+		Name:        "shadow/diff",
+		Measure:     MShadowDiffCount,
+		Description: "The count of mirrored responses compared to main per route, target and mismatch",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyTarget, KeyMismatch},
+	}
+
+	// SidecarCacheView provide view for sidecar decision cache lookup count grouped by result
+	SidecarCacheView = &view.View{
+		Name:        "sidecar_cache/count",
+		Measure:     MSidecarCacheCount,
+		Description: "The count of sidecar decision cache lookups per route and result",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyVersion, KeyRoute, KeyCacheResult},
+	}
+
+	views = []*view.View{RequestCountView, RequestLatencyView, RampStepView, RampNextTransitionView, CircuitBreakerStateView, CanaryRequestBudgetView, CanaryInflightView, ShadowCountView, ShadowLatencyView, ShadowDiffView, SidecarCacheView}
 )
 
 // Initialize register views and default Prometheus exporter
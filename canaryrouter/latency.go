@@ -0,0 +1,128 @@
+package canaryrouter
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyBucketGrowth is the ratio between the bounds of consecutive latency buckets, i.e. the
+	// precision of the computed percentiles
+	latencyBucketGrowth = 1.1
+
+	latencyBucketMin = time.Millisecond
+	latencyBucketMax = 2 * time.Minute
+)
+
+// latencyBuckets holds the upper bounds of the latency histogram buckets, the last bucket being unbounded
+var latencyBuckets = newLatencyBuckets()
+
+func newLatencyBuckets() []time.Duration {
+	var buckets []time.Duration
+	for bound := float64(latencyBucketMin); bound < float64(latencyBucketMax); bound *= latencyBucketGrowth {
+		buckets = append(buckets, time.Duration(bound))
+	}
+
+	return append(buckets, time.Duration(math.MaxInt64))
+}
+
+func latencyBucket(latency time.Duration) int {
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			return i
+		}
+	}
+
+	return len(latencyBuckets) - 1
+}
+
+type latencySlot struct {
+	second   int64
+	requests uint64
+	counts   []uint64
+}
+
+// latencyWindow holds the latency histogram of the requests over a rolling window, made of one second slots
+type latencyWindow struct {
+	mu    sync.Mutex
+	slots []latencySlot
+}
+
+func newLatencyWindow(window int) *latencyWindow {
+	if window <= 0 {
+		window = defaultErrorRateWindow
+	}
+
+	w := &latencyWindow{slots: make([]latencySlot, window)}
+	for i := range w.slots {
+		w.slots[i].counts = make([]uint64, len(latencyBuckets))
+	}
+
+	return w
+}
+
+// record counts a request served in latency, which completed at now
+func (w *latencyWindow) record(latency time.Duration, now time.Time) {
+	second := now.Unix()
+	bucket := latencyBucket(latency)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	slot := &w.slots[second%int64(len(w.slots))]
+	if slot.second != second {
+		slot.second = second
+		slot.requests = 0
+		for i := range slot.counts {
+			slot.counts[i] = 0
+		}
+	}
+
+	slot.requests++
+	slot.counts[bucket]++
+}
+
+// reset forgets all the recorded requests
+func (w *latencyWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.slots {
+		w.slots[i].second = 0
+	}
+}
+
+// percentile returns the upper bound of the latency bucket holding the percentile (0-100), and the number
+// of requests within the window ending at now
+func (w *latencyWindow) percentile(percentile float64, now time.Time) (time.Duration, uint64) {
+	second := now.Unix()
+	counts := make([]uint64, len(latencyBuckets))
+	var requests uint64
+
+	w.mu.Lock()
+	for _, slot := range w.slots {
+		if age := second - slot.second; age >= 0 && age < int64(len(w.slots)) {
+			requests += slot.requests
+			for i, count := range slot.counts {
+				counts[i] += count
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	if requests == 0 {
+		return 0, 0
+	}
+
+	rank := uint64(math.Ceil(percentile / 100 * float64(requests)))
+	var cumulated uint64
+	for i, count := range counts {
+		cumulated += count
+		if cumulated >= rank {
+			return latencyBuckets[i], requests
+		}
+	}
+
+	return latencyBuckets[len(latencyBuckets)-1], requests
+}
@@ -0,0 +1,49 @@
+package canaryrouter
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_latencyWindow_percentile(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+
+	type record struct {
+		at      time.Duration
+		latency time.Duration
+		count   int
+	}
+	tests := []struct {
+		name         string
+		records      []record
+		percentile   float64
+		at           time.Duration
+		wantLatency  time.Duration
+		wantRequests uint64
+	}{
+		{name: "no request", percentile: 99, wantLatency: 0, wantRequests: 0},
+		{name: "p99 of a slow tail", records: []record{{latency: 10 * time.Millisecond, count: 98}, {latency: time.Second, count: 2}}, percentile: 99, wantLatency: time.Second, wantRequests: 100},
+		{name: "p95 ignores a slow tail", records: []record{{latency: 10 * time.Millisecond, count: 98}, {latency: time.Second, count: 2}}, percentile: 95, wantLatency: 10 * time.Millisecond, wantRequests: 100},
+		{name: "slow requests slide out of the window", records: []record{{latency: time.Second, count: 10}, {at: 30 * time.Second, latency: 10 * time.Millisecond, count: 10}}, percentile: 99, at: 60 * time.Second, wantLatency: 10 * time.Millisecond, wantRequests: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newLatencyWindow(60)
+			for _, r := range tt.records {
+				for i := 0; i < r.count; i++ {
+					w.record(r.latency, start.Add(r.at))
+				}
+			}
+
+			gotLatency, gotRequests := w.percentile(tt.percentile, start.Add(tt.at))
+			if gotRequests != tt.wantRequests {
+				t.Errorf("latencyWindow.percentile() requests = %d, want %d", gotRequests, tt.wantRequests)
+			}
+
+			// NOTE: The percentile is the upper bound of its histogram bucket
+			if gotLatency < tt.wantLatency || float64(gotLatency) > float64(tt.wantLatency)*latencyBucketGrowth {
+				t.Errorf("latencyWindow.percentile() latency = %v, want %v", gotLatency, tt.wantLatency)
+			}
+		})
+	}
+}
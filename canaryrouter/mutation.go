@@ -0,0 +1,123 @@
+package canaryrouter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+// mutation applies the request mutations instructed by the sidecar response headers, limited to
+// the allowed request headers and path rewriting
+type mutation struct {
+	headers     map[string]bool
+	rewritePath bool
+}
+
+func newMutation(mutationConfig config.SidecarMutation) (*mutation, error) {
+	m := &mutation{
+		headers:     make(map[string]bool, len(mutationConfig.Headers)),
+		rewritePath: isTrue(mutationConfig.RewritePath),
+	}
+
+	for _, name := range mutationConfig.Headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" || name == "Host" {
+			return nil, errors.Errorf("sidecar-mutation header %q is not allowed", name)
+		}
+		m.headers[name] = true
+	}
+
+	return m, nil
+}
+
+// apply mutates the request according to the sidecar decision. Instructions on request headers which are
+// not allowed are ignored.
+func (m *mutation) apply(req *http.Request, d *Decision) {
+	for _, name := range d.RemoveHeaders {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !m.isAllowed(name) {
+			continue
+		}
+		req.Header.Del(name)
+	}
+
+	for name, values := range d.SetHeaders {
+		if !m.isAllowed(name) {
+			continue
+		}
+		req.Header[name] = append([]string(nil), values...)
+	}
+
+	if path := d.RewritePath; path != "" {
+		if !m.rewritePath {
+			log.Warnf("Ignoring sidecar path rewriting, it is not allowed")
+			return
+		}
+
+		if !strings.HasPrefix(path, "/") {
+			log.Warnf("Ignoring sidecar path rewriting to %q, path must start with /", path)
+			return
+		}
+
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+}
+
+func (m *mutation) isAllowed(name string) bool {
+	if !m.headers[name] {
+		log.Warnf("Ignoring sidecar instruction on request header %q, it is not allowed", name)
+		return false
+	}
+
+	return true
+}
+
+var mutationKey = contextKey("mutation")
+
+// withMutation attaches the sidecar decision to the request, so that its mutations are applied once the
+// request is forwarded to canary
+func withMutation(req *http.Request, d *Decision) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), mutationKey, d))
+}
+
+// mutatedRequest returns a copy of the request mutated according to the decision attached by withMutation,
+// or the request itself if there is none. The request is left untouched, so that it can still be retried
+// against main.
+func (s *Server) mutatedRequest(req *http.Request) *http.Request {
+	if !s.isMutationEnabled() {
+		return req
+	}
+
+	d, ok := req.Context().Value(mutationKey).(*Decision)
+	if !ok || !d.isMutating() {
+		return req
+	}
+
+	outreq := req.WithContext(req.Context())
+
+	outURL := *req.URL
+	outreq.URL = &outURL
+
+	outreq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		outreq.Header[name] = append([]string(nil), values...)
+	}
+
+	s.mutation.apply(outreq, d)
+
+	return outreq
+}
+
+// isMutating returns whether the decision instructs to mutate the request
+func (d *Decision) isMutating() bool {
+	return len(d.SetHeaders) > 0 || len(d.RemoveHeaders) > 0 || d.RewritePath != ""
+}
+
+func (s *Server) isMutationEnabled() bool {
+	return s.mutation != nil
+}
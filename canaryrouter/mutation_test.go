@@ -0,0 +1,137 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newMutation(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.SidecarMutation
+		wantErr bool
+	}{
+		{name: "headers", args: config.SidecarMutation{Headers: []string{"X-Tenant-Id", "x-debug"}}, wantErr: false},
+		{name: "rewrite path only", args: config.SidecarMutation{RewritePath: config.Bool(true)}, wantErr: false},
+		{name: "empty header", args: config.SidecarMutation{Headers: []string{" "}}, wantErr: true},
+		{name: "host header", args: config.SidecarMutation{Headers: []string{"host"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newMutation(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newMutation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_mutation_apply(t *testing.T) {
+	m, err := newMutation(config.SidecarMutation{Headers: []string{"X-Tenant-Id", "x-debug"}, RewritePath: config.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		sidecarHeader http.Header
+		wantHeader    http.Header
+		wantPath      string
+	}{
+		{
+			name:          "no instruction",
+			sidecarHeader: http.Header{},
+			wantHeader:    http.Header{"X-Debug": {"1"}, "Authorization": {"secret"}},
+			wantPath:      "/foo/bar",
+		},
+		{
+			name:          "set allowed header",
+			sidecarHeader: http.Header{HeaderSetHeader: {"x-tenant-id: 42"}},
+			wantHeader:    http.Header{"X-Debug": {"1"}, "Authorization": {"secret"}, "X-Tenant-Id": {"42"}},
+			wantPath:      "/foo/bar",
+		},
+		{
+			name:          "overwrite allowed header",
+			sidecarHeader: http.Header{HeaderSetHeader: {"X-Debug: 0"}},
+			wantHeader:    http.Header{"X-Debug": {"0"}, "Authorization": {"secret"}},
+			wantPath:      "/foo/bar",
+		},
+		{
+			name:          "remove allowed header",
+			sidecarHeader: http.Header{HeaderRemoveHeader: {"X-Debug, X-Tenant-Id"}},
+			wantHeader:    http.Header{"Authorization": {"secret"}},
+			wantPath:      "/foo/bar",
+		},
+		{
+			name:          "disallowed headers are ignored",
+			sidecarHeader: http.Header{HeaderSetHeader: {"Authorization: forged", "X-Tenant-Id 42"}, HeaderRemoveHeader: {"Authorization"}},
+			wantHeader:    http.Header{"X-Debug": {"1"}, "Authorization": {"secret"}},
+			wantPath:      "/foo/bar",
+		},
+		{
+			name:          "rewrite path",
+			sidecarHeader: http.Header{HeaderRewritePath: {"/v2/foo/bar"}},
+			wantHeader:    http.Header{"X-Debug": {"1"}, "Authorization": {"secret"}},
+			wantPath:      "/v2/foo/bar",
+		},
+		{
+			name:          "relative path is ignored",
+			sidecarHeader: http.Header{HeaderRewritePath: {"v2/foo/bar"}},
+			wantHeader:    http.Header{"X-Debug": {"1"}, "Authorization": {"secret"}},
+			wantPath:      "/foo/bar",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo/bar?baz=1", nil)
+			req.Header.Set("X-Debug", "1")
+			req.Header.Set("Authorization", "secret")
+
+			d, err := decodeStatusCode(StatusCodeCanary, tt.sidecarHeader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m.apply(req, d)
+
+			if len(req.Header) != len(tt.wantHeader) {
+				t.Errorf("apply() header = %v, want %v", req.Header, tt.wantHeader)
+			}
+			for name := range tt.wantHeader {
+				if req.Header.Get(name) != tt.wantHeader.Get(name) {
+					t.Errorf("apply() header = %v, want %v", req.Header, tt.wantHeader)
+				}
+			}
+
+			if req.URL.Path != tt.wantPath || req.URL.RawQuery != "baz=1" {
+				t.Errorf("apply() URL = %v, want path %v", req.URL, tt.wantPath)
+			}
+		})
+	}
+}
+
+func Test_Server_mutatedRequest(t *testing.T) {
+	m, err := newMutation(config.SidecarMutation{Headers: []string{"X-Tenant-Id"}, RewritePath: config.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{mutation: m}
+
+	req := httptest.NewRequest(http.MethodGet, "/foo/bar", nil)
+	if got := s.mutatedRequest(req); got != req {
+		t.Errorf("mutatedRequest() copies the request without decision")
+	}
+
+	req = withMutation(req, &Decision{Target: TargetCanary, SetHeaders: http.Header{"X-Tenant-Id": {"42"}}, RewritePath: "/tenants/42/foo/bar"})
+	got := s.mutatedRequest(req)
+
+	if got.URL.Path != "/tenants/42/foo/bar" || got.Header.Get("X-Tenant-Id") != "42" {
+		t.Errorf("mutatedRequest() = path %q, X-Tenant-Id %q", got.URL.Path, got.Header.Get("X-Tenant-Id"))
+	}
+	if req.URL.Path != "/foo/bar" || req.Header.Get("X-Tenant-Id") != "" {
+		t.Errorf("mutatedRequest() mutates the original request: path %q, X-Tenant-Id %q", req.URL.Path, req.Header.Get("X-Tenant-Id"))
+	}
+}
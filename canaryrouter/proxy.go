@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/juju/errors"
@@ -22,6 +23,20 @@ func newTransport(clientConfig config.HTTPClientConfig) *http.Transport {
 	}
 }
 
+// isUpgradeRequest returns whether the request asks for a protocol upgrade (e.g. websocket), in which case
+// the reverse proxy hijacks the client connection
+func isUpgradeRequest(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func newReverseProxy(target, customHost string, dumpResponse bool) (*httputil.ReverseProxy, error) {
 	url, err := url.ParseRequestURI(target)
 	if err != nil {
@@ -1,6 +1,8 @@
 package canaryrouter
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -53,3 +55,26 @@ func Test_newReverseProxy(t *testing.T) {
 	}
 
 }
+
+func Test_isUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection []string
+		want       bool
+	}{
+		{name: "no connection header", want: false},
+		{name: "keep-alive", connection: []string{"keep-alive"}, want: false},
+		{name: "upgrade", connection: []string{"Upgrade"}, want: true},
+		{name: "upgrade among other tokens", connection: []string{"keep-alive, upgrade"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header["Connection"] = tt.connection
+
+			if got := isUpgradeRequest(req); got != tt.want {
+				t.Errorf("isUpgradeRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
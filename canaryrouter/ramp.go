@@ -0,0 +1,222 @@
+package canaryrouter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
+)
+
+const (
+	rampTickInterval    = time.Second
+	rampPersistInterval = 10 * time.Second
+)
+
+type rampStep struct {
+	weight   uint64
+	duration time.Duration
+}
+
+// rampState is the progress of the ramp persisted in the state file
+type rampState struct {
+	Step int `json:"step"`
+
+	// ElapsedSeconds is how long the current step has been active, excluding the paused time
+	ElapsedSeconds float64 `json:"elapsed-seconds"`
+}
+
+// ramp advances the split canary weight through its steps. It pauses whenever shouldPause
+// returns true, e.g. when the canary circuit breaker has tripped. shouldPause must not change the
+// circuit breaker state, as it is called in the background.
+type ramp struct {
+	steps       []rampStep
+	stateFile   string
+	splitter    *splitter
+	shouldPause func() (string, bool)
+	metricCtx   context.Context
+	stop        chan struct{}
+	stopOnce    sync.Once
+
+	mu          sync.Mutex
+	step        int
+	elapsed     time.Duration
+	paused      bool
+	lastPersist time.Time
+}
+
+func newRamp(rampConfig config.Ramp, sp *splitter, shouldPause func() (string, bool), metricCtx context.Context) (*ramp, error) {
+	r := &ramp{
+		stateFile:   rampConfig.StateFile,
+		splitter:    sp,
+		shouldPause: shouldPause,
+		metricCtx:   metricCtx,
+		stop:        make(chan struct{}),
+	}
+
+	for i, stepConfig := range rampConfig.Steps {
+		weight, err := toBasisPoints(stepConfig.CanaryWeight)
+		if err != nil {
+			return nil, errors.Annotatef(err, "ramp steps[%d] canary-weight", i)
+		}
+
+		isLast := i == len(rampConfig.Steps)-1
+		if !isLast && stepConfig.Duration <= 0 {
+			return nil, errors.Errorf("ramp steps[%d] duration must be positive, got %d", i, stepConfig.Duration)
+		}
+
+		r.steps = append(r.steps, rampStep{weight: weight, duration: time.Duration(stepConfig.Duration) * time.Second})
+	}
+
+	if err := r.restore(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.splitter.setWeight(r.steps[r.step].weight)
+
+	return r, nil
+}
+
+// restore loads the ramp progress from the state file, if it exists
+func (r *ramp) restore() error {
+	if r.stateFile == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(r.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Annotate(err, "ramp state-file")
+	}
+
+	var state rampState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return errors.Annotatef(err, "ramp state-file %s", r.stateFile)
+	}
+
+	if state.Step < 0 || state.Step >= len(r.steps) {
+		return errors.Errorf("ramp state-file %s has step %d, but there are only %d steps", r.stateFile, state.Step, len(r.steps))
+	}
+
+	r.step = state.Step
+	r.elapsed = time.Duration(state.ElapsedSeconds * float64(time.Second))
+	log.Printf("Ramp resumed at step %d (canary weight %.2f%%)", r.step, float64(r.steps[r.step].weight)*100/splitScale)
+
+	return nil
+}
+
+// persist saves the ramp progress in the state file
+func (r *ramp) persist() error {
+	if r.stateFile == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(rampState{Step: r.step, ElapsedSeconds: r.elapsed.Seconds()})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// NOTE: Write to a temporary file first, so that the state file is never left half written
+	tmpFile := filepath.Join(filepath.Dir(r.stateFile), "."+filepath.Base(r.stateFile)+".tmp")
+	if err := ioutil.WriteFile(tmpFile, content, 0644); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(os.Rename(tmpFile, r.stateFile))
+}
+
+func (r *ramp) isLastStep() bool {
+	return r.step == len(r.steps)-1
+}
+
+// nextTransition returns when the current step will end, or zero time if it is the last step
+func (r *ramp) nextTransition(now time.Time) time.Time {
+	if r.isLastStep() {
+		return time.Time{}
+	}
+
+	return now.Add(r.steps[r.step].duration - r.elapsed)
+}
+
+// advance moves the ramp forward by dt, unless it is paused
+func (r *ramp) advance(dt time.Duration, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reason, pause := r.shouldPause()
+	if pause != r.paused {
+		r.paused = pause
+		if pause {
+			log.Printf("Ramp paused at step %d: %s", r.step, reason)
+		} else {
+			log.Printf("Ramp resumed at step %d", r.step)
+		}
+	}
+
+	stepChanged := false
+	if !r.paused && !r.isLastStep() {
+		r.elapsed += dt
+
+		for !r.isLastStep() && r.elapsed >= r.steps[r.step].duration {
+			r.elapsed -= r.steps[r.step].duration
+			r.step++
+			stepChanged = true
+		}
+
+		if r.isLastStep() {
+			r.elapsed = 0
+		}
+	}
+
+	if stepChanged {
+		r.splitter.setWeight(r.steps[r.step].weight)
+		log.Printf("Ramp advanced to step %d (canary weight %.2f%%)", r.step, float64(r.steps[r.step].weight)*100/splitScale)
+	}
+
+	if stepChanged || now.Sub(r.lastPersist) >= rampPersistInterval {
+		if err := r.persist(); err != nil {
+			log.Errorf("Failed to persist ramp state: %v", errors.ErrorStack(err))
+		}
+		r.lastPersist = now
+	}
+
+	instrumentation.RecordRampStep(r.metricCtx, r.step, r.nextTransition(now))
+}
+
+// run advances the ramp periodically, until the ramp is closed
+func (r *ramp) run() {
+	ticker := time.NewTicker(rampTickInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.advance(now.Sub(last), now)
+			last = now
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// close stops the ramp and persists its progress
+func (r *ramp) close() error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return errors.Trace(r.persist())
+}
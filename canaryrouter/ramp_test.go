@@ -0,0 +1,165 @@
+package canaryrouter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newRamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.Ramp
+		wantErr bool
+	}{
+		{name: "valid", args: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 1, Duration: 60}, {CanaryWeight: 100}}}, wantErr: false},
+		{name: "bad weight", args: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 101, Duration: 60}, {CanaryWeight: 100}}}, wantErr: true},
+		{name: "missing duration", args: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 1}, {CanaryWeight: 100}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, err := newSplitter(config.Split{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = newRamp(tt.args, sp, func() (string, bool) { return "", false }, context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRamp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ramp_advance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rampConfig := config.Ramp{
+		Steps: []config.RampStep{
+			{CanaryWeight: 1, Duration: 30 * 60},
+			{CanaryWeight: 5, Duration: 60 * 60},
+			{CanaryWeight: 25, Duration: 2 * 60 * 60},
+			{CanaryWeight: 100},
+		},
+		StateFile: filepath.Join(dir, "ramp.json"),
+	}
+
+	paused := false
+	shouldPause := func() (string, bool) { return "Canary error limit reached", paused }
+
+	sp, err := newSplitter(config.Split{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newRamp(rampConfig, sp, shouldPause, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	assertStep := func(t *testing.T, wantStep int, wantWeight uint64) {
+		t.Helper()
+		if r.step != wantStep || sp.weight != wantWeight {
+			t.Errorf("step = %d weight = %d, want step = %d weight = %d", r.step, sp.weight, wantStep, wantWeight)
+		}
+	}
+
+	assertStep(t, 0, 100)
+
+	now = now.Add(29 * time.Minute)
+	r.advance(29*time.Minute, now)
+	assertStep(t, 0, 100)
+
+	if got, want := r.nextTransition(now), now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("nextTransition() = %v, want %v", got, want)
+	}
+
+	now = now.Add(2 * time.Minute)
+	r.advance(2*time.Minute, now)
+	assertStep(t, 1, 500)
+
+	// the ramp does not advance while paused
+	paused = true
+	now = now.Add(3 * time.Hour)
+	r.advance(3*time.Hour, now)
+	assertStep(t, 1, 500)
+
+	paused = false
+	now = now.Add(59 * time.Minute)
+	r.advance(59*time.Minute, now)
+	assertStep(t, 2, 2500)
+
+	// a restart resumes the ramp from its persisted step
+	sp, err = newSplitter(config.Split{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = newRamp(rampConfig, sp, shouldPause, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStep(t, 2, 2500)
+
+	now = now.Add(2 * time.Hour)
+	r.advance(2*time.Hour, now)
+	assertStep(t, 3, 10000)
+
+	if got := r.nextTransition(now); !got.IsZero() {
+		t.Errorf("nextTransition() on last step = %v, want zero time", got)
+	}
+}
+
+func Test_ramp_close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sp, err := newSplitter(config.Split{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateFile := filepath.Join(dir, "ramp.json")
+	rampConfig := config.Ramp{Steps: []config.RampStep{{CanaryWeight: 1, Duration: 60}, {CanaryWeight: 100}}, StateFile: stateFile}
+	r, err := newRamp(rampConfig, sp, func() (string, bool) { return "", false }, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.run()
+		close(done)
+	}()
+
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run() did not return once the ramp is closed")
+	}
+
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Errorf("close() did not persist the ramp state: %v", err)
+	}
+
+	if err := r.close(); err != nil {
+		t.Errorf("second close() error = %v", err)
+	}
+}
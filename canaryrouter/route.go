@@ -0,0 +1,170 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/imdario/mergo"
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+// DefaultRouteName is the route name of requests handled by the top level configuration
+const DefaultRouteName = "default"
+
+// routePatterns returns the http.ServeMux patterns dispatching to the route
+func routePatterns(route config.Route) []string {
+	prefix := "/" + strings.Trim(route.PathPrefix, "/")
+	if prefix == "/" {
+		return []string{route.Host + prefix}
+	}
+
+	// NOTE: Register the prefix both with and without trailing slash, as http.ServeMux would
+	// otherwise redirect requests to the prefix itself
+	return []string{route.Host + prefix, route.Host + prefix + "/"}
+}
+
+// routeConfig returns the route configuration, defaulting to the top level configuration values
+func routeConfig(route config.Route, base config.Config) (config.Config, error) {
+	cfg := route.Config
+	base.Routes = nil
+
+	// NOTE: A route setting its routing mode (sidecar, expression or split) does not inherit the other ones,
+	// as the sidecar would otherwise take precedence over its expression or split. sidecar-url and
+	// sidecar-urls both configure the sidecar, so a route setting either of them does not inherit the other.
+	routeSidecar := cfg.SidecarURL != "" || len(cfg.SidecarURLs) > 0
+	routeExpression := cfg.Expression != ""
+	routeSplit := cfg.Split.CanaryWeight != nil || len(cfg.Split.Ramp.Steps) > 0
+	if routeSidecar || routeExpression || routeSplit {
+		base.SidecarURL = ""
+		base.SidecarURLs = nil
+
+		if !routeExpression {
+			base.Expression = ""
+		}
+		if !routeSplit {
+			base.Split = config.Split{}
+		}
+	}
+
+	// NOTE: mergo would merge the top level values into the false or 0 values set by the route, so the
+	// top level values are dropped instead
+	if cfg.Split.CanaryWeight != nil {
+		base.Split.CanaryWeight = nil
+	}
+	if cfg.Shadow.SampleRate != nil {
+		base.Shadow.SampleRate = nil
+	}
+	if cfg.Shadow.Diff.Enabled != nil {
+		base.Shadow.Diff.Enabled = nil
+	}
+	if cfg.Fallback.Enabled != nil {
+		base.Fallback.Enabled = nil
+	}
+	if cfg.SidecarMutation.RewritePath != nil {
+		base.SidecarMutation.RewritePath = nil
+	}
+
+	// NOTE: The ramp of a route is independent from the top level one, so it must not persist its progress
+	// to the same state file
+	base.Split.Ramp.StateFile = ""
+
+	if err := mergo.Merge(&cfg, base); err != nil {
+		return cfg, errors.Trace(err)
+	}
+
+	return cfg, nil
+}
+
+// newRouteHandler dispatches the requests to the server of their route, or to defaultHandler
+// if no route matches
+func newRouteHandler(cfg config.Config, version string, defaultHandler http.Handler, o options) (_ http.Handler, _ []*Server, err error) {
+	serveMux := http.NewServeMux()
+	registered := make(map[string]string)
+
+	rampStateFiles := make(map[string]string)
+	if err := claimRampStateFile(rampStateFiles, cfg.Split.Ramp, DefaultRouteName); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	var routeServers []*Server
+	defer func() {
+		if err != nil {
+			for _, routeServer := range routeServers {
+				_ = routeServer.Close()
+			}
+		}
+	}()
+
+	for i, route := range cfg.Routes {
+		name := route.Name
+		if name == "" {
+			name = strings.TrimSuffix(routePatterns(route)[0], "/")
+		}
+
+		if route.Host == "" && route.PathPrefix == "" {
+			return nil, nil, errors.Errorf("route %s must have host or path-prefix", name)
+		}
+
+		if len(route.Routes) > 0 {
+			return nil, nil, errors.Errorf("route %s can not have nested routes", name)
+		}
+
+		routeCfg, err := routeConfig(route, cfg)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "route %s", name)
+		}
+
+		if err := claimRampStateFile(rampStateFiles, routeCfg.Split.Ramp, name); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		routeServer, err := newServer(routeCfg, version, name, o)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "routes[%d] %s", i, name)
+		}
+		routeServers = append(routeServers, routeServer)
+
+		// NOTE: Scope the affinity cookie to the route path, so that it does not overwrite the one of the
+		// top level configuration or of the other routes
+		if routeServer.isAffinityEnabled() {
+			routeServer.affinity.cookiePath = routePatterns(route)[0][len(route.Host):]
+		}
+
+		for _, pattern := range routePatterns(route) {
+			if other, exists := registered[pattern]; exists {
+				return nil, nil, errors.Errorf("route %s conflicts with route %s", name, other)
+			}
+
+			registered[pattern] = name
+			serveMux.Handle(pattern, routeServer)
+		}
+	}
+
+	if _, exists := registered["/"]; !exists {
+		serveMux.Handle("/", defaultHandler)
+	}
+
+	return serveMux, routeServers, nil
+}
+
+// claimRampStateFile records the ramp state file of the route in claimed, it fails if the ramp of another
+// route already persists its progress to the same file
+func claimRampStateFile(claimed map[string]string, rampConfig config.Ramp, route string) error {
+	if len(rampConfig.Steps) == 0 || rampConfig.StateFile == "" {
+		return nil
+	}
+
+	path, err := filepath.Abs(rampConfig.StateFile)
+	if err != nil {
+		return errors.Annotatef(err, "route %s ramp state-file", route)
+	}
+
+	if other, exists := claimed[path]; exists {
+		return errors.Errorf("route %s ramp state-file %s is already used by route %s", route, rampConfig.StateFile, other)
+	}
+	claimed[path] = route
+
+	return nil
+}
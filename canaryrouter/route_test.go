@@ -0,0 +1,214 @@
+package canaryrouter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_routePatterns(t *testing.T) {
+	tests := []struct {
+		name  string
+		route config.Route
+		want  []string
+	}{
+		{name: "host only", route: config.Route{Host: "api.localhost"}, want: []string{"api.localhost/"}},
+		{name: "path prefix", route: config.Route{PathPrefix: "/orders"}, want: []string{"/orders", "/orders/"}},
+		{name: "path prefix with trailing slash", route: config.Route{PathPrefix: "/orders/"}, want: []string{"/orders", "/orders/"}},
+		{name: "host and path prefix", route: config.Route{Host: "api.localhost", PathPrefix: "orders"}, want: []string{"api.localhost/orders", "api.localhost/orders/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routePatterns(tt.route); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("routePatterns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_routeConfig(t *testing.T) {
+	base := config.Config{
+		MainTarget:     "http://main.localhost",
+		CanaryTarget:   "http://canary.localhost",
+		SidecarURL:     "http://sidecar.localhost",
+		TrimPrefix:     "/api",
+		CircuitBreaker: config.CircuitBreaker{RequestLimitCanary: 10},
+		Routes:         []config.Route{{PathPrefix: "/orders"}},
+	}
+
+	route := config.Route{
+		PathPrefix: "/orders",
+		Config: config.Config{
+			CanaryTarget: "http://orders-canary.localhost",
+			TrimPrefix:   "/orders",
+		},
+	}
+
+	got, err := routeConfig(route, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := config.Config{
+		MainTarget:     "http://main.localhost",
+		CanaryTarget:   "http://orders-canary.localhost",
+		SidecarURL:     "http://sidecar.localhost",
+		TrimPrefix:     "/orders",
+		CircuitBreaker: config.CircuitBreaker{RequestLimitCanary: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routeConfig() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_routeConfig_sidecarURLs(t *testing.T) {
+	tests := []struct {
+		name            string
+		base            config.Config
+		route           config.Config
+		wantSidecarURL  string
+		wantSidecarURLs []string
+	}{
+		{
+			name:            "inherits sidecar-urls",
+			base:            config.Config{SidecarURLs: []string{"http://sidecar-1.localhost", "http://sidecar-2.localhost"}},
+			wantSidecarURLs: []string{"http://sidecar-1.localhost", "http://sidecar-2.localhost"},
+		},
+		{
+			name:           "sidecar-url overrides sidecar-urls",
+			base:           config.Config{SidecarURLs: []string{"http://sidecar-1.localhost", "http://sidecar-2.localhost"}},
+			route:          config.Config{SidecarURL: "http://orders-sidecar.localhost"},
+			wantSidecarURL: "http://orders-sidecar.localhost",
+		},
+		{
+			name:            "sidecar-urls overrides sidecar-url",
+			base:            config.Config{SidecarURL: "http://sidecar.localhost"},
+			route:           config.Config{SidecarURLs: []string{"http://orders-sidecar.localhost"}},
+			wantSidecarURLs: []string{"http://orders-sidecar.localhost"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := routeConfig(config.Route{PathPrefix: "/orders", Config: tt.route}, tt.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.SidecarURL != tt.wantSidecarURL || !reflect.DeepEqual(got.SidecarURLs, tt.wantSidecarURLs) {
+				t.Errorf("routeConfig() sidecar = %q, %v, want %q, %v", got.SidecarURL, got.SidecarURLs, tt.wantSidecarURL, tt.wantSidecarURLs)
+			}
+		})
+	}
+}
+
+func Test_routeConfig_routingMode(t *testing.T) {
+	tests := []struct {
+		name           string
+		base           config.Config
+		route          config.Config
+		wantSidecarURL string
+		wantExpression string
+		wantSplit      config.Split
+	}{
+		{
+			name:           "inherits routing mode",
+			base:           config.Config{SidecarURL: "http://sidecar.localhost", Expression: "true"},
+			wantSidecarURL: "http://sidecar.localhost",
+			wantExpression: "true",
+		},
+		{
+			name:           "expression does not inherit sidecar nor split",
+			base:           config.Config{SidecarURL: "http://sidecar.localhost", Split: config.Split{CanaryWeight: config.Float64(100)}},
+			route:          config.Config{Expression: "true"},
+			wantExpression: "true",
+		},
+		{
+			name:      "split does not inherit sidecar nor expression",
+			base:      config.Config{SidecarURL: "http://sidecar.localhost", Expression: "true", Split: config.Split{Mode: SplitModeDeterministic}},
+			route:     config.Config{Split: config.Split{CanaryWeight: config.Float64(10)}},
+			wantSplit: config.Split{CanaryWeight: config.Float64(10), Mode: SplitModeDeterministic},
+		},
+		{
+			name:           "sidecar does not inherit expression nor split",
+			base:           config.Config{Expression: "true", Split: config.Split{CanaryWeight: config.Float64(100)}},
+			route:          config.Config{SidecarURL: "http://orders-sidecar.localhost"},
+			wantSidecarURL: "http://orders-sidecar.localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := routeConfig(config.Route{PathPrefix: "/orders", Config: tt.route}, tt.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.SidecarURL != tt.wantSidecarURL || got.Expression != tt.wantExpression || !reflect.DeepEqual(got.Split, tt.wantSplit) {
+				t.Errorf("routeConfig() = %q, %q, %+v, want %q, %q, %+v",
+					got.SidecarURL, got.Expression, got.Split, tt.wantSidecarURL, tt.wantExpression, tt.wantSplit)
+			}
+		})
+	}
+}
+
+func Test_routeConfig_zeroValues(t *testing.T) {
+	base := config.Config{
+		Split:    config.Split{CanaryWeight: config.Float64(100)},
+		Shadow:   config.Shadow{SampleRate: config.Float64(10), Diff: config.ShadowDiff{Enabled: config.Bool(true)}},
+		Fallback: config.Fallback{Enabled: config.Bool(true), StatusCodes: []int{502}},
+	}
+
+	route := config.Config{
+		Split:    config.Split{CanaryWeight: config.Float64(0)},
+		Shadow:   config.Shadow{SampleRate: config.Float64(0), Diff: config.ShadowDiff{Enabled: config.Bool(false)}},
+		Fallback: config.Fallback{Enabled: config.Bool(false)},
+	}
+
+	got, err := routeConfig(config.Route{PathPrefix: "/orders", Config: route}, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *got.Split.CanaryWeight != 0 || *got.Shadow.SampleRate != 0 || *got.Shadow.Diff.Enabled || *got.Fallback.Enabled {
+		t.Errorf("routeConfig() overrides the route zero values: %+v, %+v, %+v", got.Split, got.Shadow, got.Fallback)
+	}
+
+	if *base.Split.CanaryWeight != 100 || !*base.Shadow.Diff.Enabled || !*base.Fallback.Enabled {
+		t.Errorf("routeConfig() modifies the top level values: %+v, %+v, %+v", base.Split, base.Shadow, base.Fallback)
+	}
+
+	if !reflect.DeepEqual(got.Fallback.StatusCodes, []int{502}) {
+		t.Errorf("routeConfig() fallback status codes = %v, want %v", got.Fallback.StatusCodes, []int{502})
+	}
+}
+
+func Test_routeConfig_rampStateFile(t *testing.T) {
+	base := config.Config{
+		Split: config.Split{Ramp: config.Ramp{
+			Steps:     []config.RampStep{{CanaryWeight: 1, Duration: 60}, {CanaryWeight: 100}},
+			StateFile: "ramp.json",
+		}},
+	}
+
+	tests := []struct {
+		name          string
+		route         config.Config
+		wantStateFile string
+	}{
+		{name: "inherited ramp", route: config.Config{}, wantStateFile: ""},
+		{name: "own ramp", route: config.Config{Split: config.Split{Ramp: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 50}}}}}, wantStateFile: ""},
+		{name: "own state file", route: config.Config{Split: config.Split{Ramp: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 50}}, StateFile: "orders.json"}}}, wantStateFile: "orders.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := routeConfig(config.Route{PathPrefix: "/orders", Config: tt.route}, base)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Split.Ramp.StateFile != tt.wantStateFile {
+				t.Errorf("routeConfig() ramp state-file = %q, want %q", got.Split.Ramp.StateFile, tt.wantStateFile)
+			}
+		})
+	}
+}
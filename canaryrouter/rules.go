@@ -0,0 +1,294 @@
+package canaryrouter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+const (
+	// RuleTargetMain forwards the matching request to main
+	RuleTargetMain = "main"
+
+	// RuleTargetCanary forwards the matching request to canary, circuit breaker limits still apply.
+	// Any other named target can be used as well.
+	RuleTargetCanary = "canary"
+
+	// RuleTargetSidecar leaves the routing decision of the matching request to the sidecar
+	// (or expression, split if no sidecar is provided)
+	RuleTargetSidecar = "sidecar"
+)
+
+type rule struct {
+	name    string
+	target  string
+	methods map[string]bool
+	host    string
+	path    pathMatcher
+	headers []valueMatcher
+	query   []valueMatcher
+	cookies []valueMatcher
+}
+
+type pathMatcher struct {
+	prefix string
+	glob   string
+	regex  *regexp.Regexp
+}
+
+type valueMatcher struct {
+	name           string
+	equals         string
+	prefix         string
+	regex          *regexp.Regexp
+	greaterOrEqual *float64
+	lessOrEqual    *float64
+}
+
+func newRules(rulesConfig []config.Rule) ([]*rule, error) {
+	rules := make([]*rule, 0, len(rulesConfig))
+
+	for i, ruleConfig := range rulesConfig {
+		r, err := newRule(ruleConfig)
+		if err != nil {
+			return nil, errors.Annotatef(err, "rules[%d]", i)
+		}
+
+		if r.name == "" {
+			r.name = fmt.Sprintf("#%d", i)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func newRule(ruleConfig config.Rule) (*rule, error) {
+	if ruleConfig.Target == "" {
+		return nil, errors.New("target must not be empty")
+	}
+
+	r := &rule{
+		name:   ruleConfig.Name,
+		target: strings.ToLower(ruleConfig.Target),
+		host:   strings.ToLower(ruleConfig.Host),
+	}
+
+	if len(ruleConfig.Methods) > 0 {
+		r.methods = make(map[string]bool, len(ruleConfig.Methods))
+		for _, method := range ruleConfig.Methods {
+			r.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	if _, err := path.Match(r.host, ""); err != nil {
+		return nil, errors.Annotate(err, "host")
+	}
+
+	var err error
+	if r.path, err = newPathMatcher(ruleConfig.Path); err != nil {
+		return nil, errors.Annotate(err, "path")
+	}
+
+	if r.headers, err = newValueMatchers(ruleConfig.Headers); err != nil {
+		return nil, errors.Annotate(err, "headers")
+	}
+
+	if r.query, err = newValueMatchers(ruleConfig.Query); err != nil {
+		return nil, errors.Annotate(err, "query")
+	}
+
+	if r.cookies, err = newValueMatchers(ruleConfig.Cookies); err != nil {
+		return nil, errors.Annotate(err, "cookies")
+	}
+
+	return r, nil
+}
+
+func newPathMatcher(pathConfig config.PathMatcher) (pathMatcher, error) {
+	m := pathMatcher{prefix: pathConfig.Prefix, glob: pathConfig.Glob}
+
+	if _, err := path.Match(m.glob, ""); err != nil {
+		return m, errors.Trace(err)
+	}
+
+	if pathConfig.Regex != "" {
+		regex, err := regexp.Compile(pathConfig.Regex)
+		if err != nil {
+			return m, errors.Trace(err)
+		}
+		m.regex = regex
+	}
+
+	return m, nil
+}
+
+func newValueMatchers(valuesConfig []config.ValueMatcher) ([]valueMatcher, error) {
+	matchers := make([]valueMatcher, 0, len(valuesConfig))
+
+	for _, valueConfig := range valuesConfig {
+		if valueConfig.Name == "" {
+			return nil, errors.New("name must not be empty")
+		}
+
+		m := valueMatcher{
+			name:           valueConfig.Name,
+			equals:         valueConfig.Equals,
+			prefix:         valueConfig.Prefix,
+			greaterOrEqual: valueConfig.GreaterOrEqual,
+			lessOrEqual:    valueConfig.LessOrEqual,
+		}
+
+		if valueConfig.Regex != "" {
+			regex, err := regexp.Compile(valueConfig.Regex)
+			if err != nil {
+				return nil, errors.Annotate(err, valueConfig.Name)
+			}
+			m.regex = regex
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+func (r *rule) matches(req *http.Request) bool {
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+
+	if r.host != "" {
+		if matched, _ := path.Match(r.host, requestHostname(req)); !matched {
+			return false
+		}
+	}
+
+	if !r.path.matches(req.URL.Path) {
+		return false
+	}
+
+	for _, m := range r.headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(m.name)]
+		if !ok || !m.matches(values[0]) {
+			return false
+		}
+	}
+
+	if len(r.query) > 0 {
+		query := req.URL.Query()
+		for _, m := range r.query {
+			values, ok := query[m.name]
+			if !ok || !m.matches(values[0]) {
+				return false
+			}
+		}
+	}
+
+	for _, m := range r.cookies {
+		cookie, err := req.Cookie(m.name)
+		if err != nil || !m.matches(cookie.Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m pathMatcher) matches(reqPath string) bool {
+	if m.prefix != "" && !strings.HasPrefix(reqPath, m.prefix) {
+		return false
+	}
+
+	if m.glob != "" {
+		if matched, _ := path.Match(m.glob, reqPath); !matched {
+			return false
+		}
+	}
+
+	if m.regex != nil && !m.regex.MatchString(reqPath) {
+		return false
+	}
+
+	return true
+}
+
+func (m valueMatcher) matches(value string) bool {
+	if m.equals != "" && value != m.equals {
+		return false
+	}
+
+	if m.prefix != "" && !strings.HasPrefix(value, m.prefix) {
+		return false
+	}
+
+	if m.regex != nil && !m.regex.MatchString(value) {
+		return false
+	}
+
+	if m.greaterOrEqual != nil || m.lessOrEqual != nil {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+
+		if m.greaterOrEqual != nil && number < *m.greaterOrEqual {
+			return false
+		}
+
+		if m.lessOrEqual != nil && number > *m.lessOrEqual {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestHostname returns the lowercased request host without its port
+func requestHostname(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.ToLower(host)
+}
+
+func (s *Server) hasRules() bool {
+	return len(s.rules) > 0
+}
+
+// viaRules forwards the request according to the first matching rule, or calls next
+// if no rule matches or the matching rule leaves the decision to the sidecar
+func (s *Server) viaRules(next http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range s.rules {
+			if !r.matches(req) {
+				continue
+			}
+
+			switch r.target {
+			case RuleTargetMain:
+				req = setRoutingReason(req, "Matched rule %s", r.name)
+				s.serveMain(w, req)
+			case RuleTargetSidecar:
+				next(w, req)
+			default:
+				s.serveCanaryWithinLimit(w, req, s.canaryTargets[r.target], fmt.Sprintf("Matched rule %s", r.name))
+			}
+
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,87 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []config.Rule
+		wantErr bool
+	}{
+		{name: "empty", args: nil, wantErr: false},
+		{name: "valid", args: []config.Rule{{Target: RuleTargetCanary, Path: config.PathMatcher{Regex: "^/orders/[0-9]+$"}}}, wantErr: false},
+		{name: "named target", args: []config.Rule{{Target: "beta"}}, wantErr: false},
+		{name: "empty target", args: []config.Rule{{Name: "no-target"}}, wantErr: true},
+		{name: "bad path regex", args: []config.Rule{{Target: RuleTargetMain, Path: config.PathMatcher{Regex: "("}}}, wantErr: true},
+		{name: "bad path glob", args: []config.Rule{{Target: RuleTargetMain, Path: config.PathMatcher{Glob: "/orders/["}}}, wantErr: true},
+		{name: "header without name", args: []config.Rule{{Target: RuleTargetMain, Headers: []config.ValueMatcher{{Equals: "1"}}}}, wantErr: true},
+		{name: "bad header regex", args: []config.Rule{{Target: RuleTargetMain, Headers: []config.ValueMatcher{{Name: "X-Foo", Regex: "["}}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRules(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_rule_matches(t *testing.T) {
+	five := float64(5)
+
+	ordersRule := config.Rule{
+		Target:  RuleTargetCanary,
+		Methods: []string{"post"},
+		Path:    config.PathMatcher{Glob: "/orders/*"},
+		Headers: []config.ValueMatcher{{Name: "x-app-version", GreaterOrEqual: &five}},
+	}
+
+	tests := []struct {
+		name   string
+		rule   config.Rule
+		method string
+		url    string
+		setup  func(req *http.Request)
+		want   bool
+	}{
+		{name: "empty rule matches everything", rule: config.Rule{Target: RuleTargetMain}, method: http.MethodGet, url: "http://localhost/foo", setup: func(req *http.Request) {}, want: true},
+		{name: "orders matches", rule: ordersRule, method: http.MethodPost, url: "http://localhost/orders/42", setup: func(req *http.Request) { req.Header.Set("X-App-Version", "5") }, want: true},
+		{name: "orders newer version", rule: ordersRule, method: http.MethodPost, url: "http://localhost/orders/42", setup: func(req *http.Request) { req.Header.Set("X-App-Version", "12.1") }, want: true},
+		{name: "orders older version", rule: ordersRule, method: http.MethodPost, url: "http://localhost/orders/42", setup: func(req *http.Request) { req.Header.Set("X-App-Version", "4") }, want: false},
+		{name: "orders non numeric version", rule: ordersRule, method: http.MethodPost, url: "http://localhost/orders/42", setup: func(req *http.Request) { req.Header.Set("X-App-Version", "five") }, want: false},
+		{name: "orders without version", rule: ordersRule, method: http.MethodPost, url: "http://localhost/orders/42", setup: func(req *http.Request) {}, want: false},
+		{name: "orders other method", rule: ordersRule, method: http.MethodGet, url: "http://localhost/orders/42", setup: func(req *http.Request) { req.Header.Set("X-App-Version", "5") }, want: false},
+		{name: "orders nested path", rule: ordersRule, method: http.MethodPost, url: "http://localhost/orders/42/items", setup: func(req *http.Request) { req.Header.Set("X-App-Version", "5") }, want: false},
+		{name: "path prefix", rule: config.Rule{Target: RuleTargetMain, Path: config.PathMatcher{Prefix: "/api/"}}, method: http.MethodGet, url: "http://localhost/api/v1/foo", setup: func(req *http.Request) {}, want: true},
+		{name: "path regex", rule: config.Rule{Target: RuleTargetMain, Path: config.PathMatcher{Regex: "^/v[0-9]+/"}}, method: http.MethodGet, url: "http://localhost/vx/foo", setup: func(req *http.Request) {}, want: false},
+		{name: "host glob", rule: config.Rule{Target: RuleTargetMain, Host: "*.example.com"}, method: http.MethodGet, url: "http://api.Example.com:8080/foo", setup: func(req *http.Request) {}, want: true},
+		{name: "host mismatch", rule: config.Rule{Target: RuleTargetMain, Host: "*.example.com"}, method: http.MethodGet, url: "http://example.org/foo", setup: func(req *http.Request) {}, want: false},
+		{name: "query equals", rule: config.Rule{Target: RuleTargetMain, Query: []config.ValueMatcher{{Name: "beta", Equals: "1"}}}, method: http.MethodGet, url: "http://localhost/foo?beta=1", setup: func(req *http.Request) {}, want: true},
+		{name: "query present", rule: config.Rule{Target: RuleTargetMain, Query: []config.ValueMatcher{{Name: "beta"}}}, method: http.MethodGet, url: "http://localhost/foo?alpha=1", setup: func(req *http.Request) {}, want: false},
+		{name: "cookie prefix", rule: config.Rule{Target: RuleTargetMain, Cookies: []config.ValueMatcher{{Name: "tier", Prefix: "gold"}}}, method: http.MethodGet, url: "http://localhost/foo", setup: func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "tier", Value: "gold-plus"}) }, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newRule(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(req)
+
+			if got := r.matches(req); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,10 @@
 package canaryrouter
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io"
-	"io/ioutil"
 	stdlog "log"
 	"net/http"
-	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
@@ -17,7 +13,6 @@ import (
 	"time"
 
 	"github.com/juju/errors"
-	"github.com/juju/ratelimit"
 	log "github.com/sirupsen/logrus"
 	"github.com/tiket-libre/canary-router/canaryrouter/config"
 	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
@@ -34,22 +29,87 @@ const (
 
 // Server holds necessary components as a proxy server
 type Server struct {
-	version                  string
-	config                   config.Config
-	mainProxy                *httputil.ReverseProxy
-	canaryProxy              *httputil.ReverseProxy
-	sidecarProxy             *httputil.ReverseProxy
-	canaryRequestLimitBucket *ratelimit.Bucket
-	canaryErrorLimitBucket   *ratelimit.Bucket
+	version        string
+	route          string
+	config         config.Config
+	handler        http.Handler
+	mainProxy      *httputil.ReverseProxy
+	canaryTargets  map[string]*canaryTarget
+	sidecar        Decider
+	ownedSidecar   Decider
+	expression     *expression
+	splitter       *splitter
+	ramp           *ramp
+	affinity       *affinity
+	rules          []*rule
+	shadow         *shadow
+	fallback       *fallback
+	sidecarCache   *sidecarCache
+	mutation       *mutation
+	sidecarFailure *sidecarFailure
+
+	// routes are the servers of the configured routes
+	routes []*Server
+
+	// mainLatencyWindow tracks the main latency when a canary target has a latency ratio limit
+	mainLatencyWindow *latencyWindow
+}
+
+// Option customizes the server created by NewServer
+type Option func(*options)
+
+type options struct {
+	decider Decider
+}
+
+// WithDecider routes the requests of every route with decider, in place of the sidecar. It may be used
+// without sidecar-url, and the sidecar settings (failure policy, circuit breaker, cache and mutation)
+// apply to decider as well.
+func WithDecider(decider Decider) Option {
+	return func(o *options) {
+		o.decider = decider
+	}
 }
 
 // NewServer initiates a new proxy server
-func NewServer(config config.Config, version string) (*Server, error) {
+func NewServer(config config.Config, version string, opts ...Option) (*Server, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	server, err := newServer(config, version, DefaultRouteName, o)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(config.Routes) > 0 {
+		server.handler, server.routes, err = newRouteHandler(config, version, server.handler, o)
+		if err != nil {
+			_ = server.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return server, nil
+}
+
+// newServer initiates a new proxy server serving a single route
+func newServer(config config.Config, version, route string, o options) (_ *Server, err error) {
 	server := &Server{
 		config:  config,
 		version: version,
+		route:   route,
+		sidecar: o.decider,
 	}
 
+	// NOTE: Release the resources already acquired, e.g. the shadow log file, if the server fails to initiate
+	defer func() {
+		if err != nil {
+			_ = server.Close()
+		}
+	}()
+
 	// === init main proxy ===
 	mainProxy, err := newReverseProxy(config.MainTarget, config.MainHeaderHost, config.Log.DebugResponseBody)
 	if err != nil {
@@ -63,58 +123,137 @@ func NewServer(config config.Config, version string) (*Server, error) {
 	}
 	server.mainProxy = mainProxy
 
-	// === init canary proxy ===
-	canaryProxy, err := newReverseProxy(config.CanaryTarget, config.CanaryHeaderHost, config.Log.DebugResponseBody)
+	// === init canary targets ===
+	if hasLatencyRatio(config) {
+		server.mainLatencyWindow = newLatencyWindow(config.CircuitBreaker.Window)
+	}
+
+	canaryTargets, err := newCanaryTargets(config, server.mainLatencyWindow, server.metricContext())
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	canaryProxy.Transport = newTransport(config.Client.MainAndCanary)
-	canaryProxy.ErrorLog = stdlog.New(os.Stderr, "[proxy-canary] ", stdlog.LstdFlags|stdlog.Llongfile)
-	canaryProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
-		log.WithField("proxy", "canary").Infof("http: proxy error: %v", err)
-		w.WriteHeader(http.StatusBadGateway)
+	server.canaryTargets = canaryTargets
+
+	// === init traffic mirroring ===
+	if valueOf(config.Shadow.SampleRate) != 0 {
+		shadow, err := newShadow(config.Shadow, server.canaryTargets, server.route, server.metricContext())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		server.shadow = shadow
+	}
+
+	// === init canary failure fallback ===
+	if isTrue(config.Fallback.Enabled) {
+		fallback, err := newFallback(config.Fallback)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		server.fallback = fallback
 	}
-	server.canaryProxy = canaryProxy
 
-	// === init sidecar proxy ===
+	// === init sidecar ===
 	if server.isSidecarProvided() {
-		sidecarProxy, err := newReverseProxy(config.SidecarURL, "", config.Log.DebugResponseBody)
+		// NOTE: A decider provided with WithDecider takes precedence over sidecar-url and sidecar-urls
+		if server.sidecar == nil {
+			sidecar, err := newSidecar(config)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			server.sidecar = sidecar
+
+			// NOTE: Only the sidecar built from the configuration is closed with the server, a decider provided
+			// with WithDecider is owned by the caller
+			server.ownedSidecar = sidecar
+		}
+
+		if config.SidecarBreaker.FailureThreshold != 0 {
+			server.sidecar, err = newSidecarBreaker(server.sidecar, config.SidecarBreaker, server.metricContext())
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		sidecarFailure, err := newSidecarFailure(config.SidecarFailure)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		sidecarProxy.Transport = newTransport(config.Client.Sidecar)
-		sidecarProxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
-			w.WriteHeader(StatusSidecarError)
-			_, errWrite := w.Write([]byte(err.Error()))
-			if errWrite != nil {
-				log.Printf("Failed to write sidecar error body")
+		server.sidecarFailure = sidecarFailure
+
+		if len(config.SidecarCache.Keys) > 0 {
+			sidecarCache, err := newSidecarCache(config.SidecarCache)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			server.sidecarCache = sidecarCache
+		}
+
+		if len(config.SidecarMutation.Headers) > 0 || isTrue(config.SidecarMutation.RewritePath) {
+			mutation, err := newMutation(config.SidecarMutation)
+			if err != nil {
+				return nil, errors.Trace(err)
 			}
+			server.mutation = mutation
 		}
-		server.sidecarProxy = sidecarProxy
 	}
 
-	if config.CircuitBreaker.RequestLimitCanary != 0 {
-		server.canaryRequestLimitBucket = ratelimit.NewBucket(infinityDuration, int64(config.CircuitBreaker.RequestLimitCanary))
+	// === init routing expression ===
+	// NOTE: The expression is compiled even if the sidecar takes precedence, so that an invalid one is rejected at startup
+	if config.Expression != "" {
+		expression, err := newExpression(config.Expression)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		server.expression = expression
 	}
 
-	if config.CircuitBreaker.ErrorLimitCanary != 0 {
-		server.canaryErrorLimitBucket = ratelimit.NewBucket(infinityDuration, int64(config.CircuitBreaker.ErrorLimitCanary))
+	// === init weighted split ===
+	if !server.isSidecarProvided() && !server.isExpressionProvided() && (valueOf(config.Split.CanaryWeight) != 0 || len(config.Split.Ramp.Steps) > 0) {
+		splitter, err := newSplitter(config.Split)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		server.splitter = splitter
+	}
 
-		currentModifyResponse := server.canaryProxy.ModifyResponse
-		server.canaryProxy.ModifyResponse = func(resp *http.Response) error {
-			if currentModifyResponse != nil {
-				_ = currentModifyResponse(resp)
-			}
+	// === init progressive rollout ramp ===
+	if server.isSplitProvided() && len(config.Split.Ramp.Steps) > 0 {
+		ramp, err := newRamp(config.Split.Ramp, server.splitter, server.defaultCanary().peekLimitReason, server.metricContext())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		server.ramp = ramp
+	}
 
-			if isErrorStatusCode(resp.StatusCode) {
-				log.Printf("Canary returns non 2xx. StatusCode:%d Status:%s", resp.StatusCode, resp.Status)
-				server.canaryErrorLimitBucket.TakeAvailable(1)
-			}
+	// === init routing affinity ===
+	if config.Sticky.SigningKey != "" {
+		affinity, err := newAffinity(config.Sticky, route)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		server.affinity = affinity
+	}
+
+	// === init routing rules ===
+	rules, err := newRules(config.Rules)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	server.rules = rules
 
-			return nil
+	for _, r := range rules {
+		if r.target != RuleTargetMain && r.target != RuleTargetSidecar && server.canaryTargets[r.target] == nil {
+			return nil, errors.Errorf("rule %s target %q is not recognized", r.name, r.target)
 		}
 	}
 
+	server.handler = server.viaProxy()
+
+	// NOTE: The background tasks are started last, so that they are not leaked if the server fails to initiate
+	if server.ramp != nil {
+		go server.ramp.run()
+	}
+
 	return server, nil
 }
 
@@ -147,32 +286,83 @@ func (s *Server) Run() error {
 	return server.ListenAndServe()
 }
 
+// Close stops the background tasks of the server and of its routes, e.g. the ramp, and releases their
+// resources, e.g. the shadow diff log files or the gRPC sidecar connections. The server should not serve requests anymore once it is closed.
+func (s *Server) Close() error {
+	var firstErr error
+	for _, routeServer := range s.routes {
+		if err := routeServer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if s.ramp != nil {
+		if err := s.ramp.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if s.shadow != nil {
+		if err := s.shadow.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if err := closeSidecar(s.ownedSidecar); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return errors.Trace(firstErr)
+}
+
 // ServeHTTP handles incoming traffics via provided proxies
 func (s *Server) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	s.viaProxy()(res, req)
+	s.handler.ServeHTTP(res, req)
 }
 
 // IsCanaryRequestLimited checks if circuit breaker (canary request limiter) feature is enabled
 func (s *Server) IsCanaryRequestLimited() bool {
-	return s.canaryRequestLimitBucket != nil
+	return s.defaultCanary().isRequestLimited()
 }
 
 // IsCanaryErrorLimited checks if circuit breaker (canary error limiter) feature is enabled
 func (s *Server) IsCanaryErrorLimited() bool {
-	return s.canaryErrorLimitBucket != nil
+	return s.defaultCanary().isErrorLimited()
+}
+
+// defaultCanary returns the canary target configured by canary-target
+func (s *Server) defaultCanary() *canaryTarget {
+	return s.canaryTargets[TargetCanary]
 }
 
 func (s *Server) isSidecarProvided() bool {
-	return s.config.SidecarURL != ""
+	return s.sidecar != nil || s.config.SidecarURL != "" || len(s.config.SidecarURLs) > 0
+}
+
+func (s *Server) isSplitProvided() bool {
+	return s.splitter != nil
 }
 
 func (s *Server) viaProxy() http.HandlerFunc {
 	var handlerFunc http.HandlerFunc
 
-	if !s.isSidecarProvided() {
-		handlerFunc = s.serveMain
-	} else {
+	switch {
+	case s.isSidecarProvided():
 		handlerFunc = s.viaProxyWithSidecar()
+	case s.isExpressionProvided():
+		handlerFunc = s.viaProxyWithExpression()
+	case s.isSplitProvided():
+		handlerFunc = s.viaProxyWithSplit()
+	default:
+		handlerFunc = s.serveMain
+	}
+
+	if s.isAffinityEnabled() && (s.isSidecarProvided() || s.isExpressionProvided() || s.isSplitProvided()) {
+		handlerFunc = s.viaAffinity(handlerFunc)
+	}
+
+	if s.hasRules() {
+		handlerFunc = s.viaRules(handlerFunc)
 	}
 
 	return func(w http.ResponseWriter, req *http.Request) {
@@ -195,6 +385,10 @@ func (s *Server) viaProxy() http.HandlerFunc {
 		}()
 
 		ctx := instrumentation.InitializeLatencyTracking(req.Context())
+		ctx, err := instrumentation.AddRouteTag(ctx, s.route)
+		if err != nil {
+			log.Errorln(err)
+		}
 		req = req.WithContext(ctx)
 		req.URL.Path = trimRequestPathPrefix(req.URL, s.config.TrimPrefix)
 
@@ -204,7 +398,7 @@ func (s *Server) viaProxy() http.HandlerFunc {
 		if err == nil {
 			req = setRoutingReason(req, "Routed via X-Canary header value: %s", xCanaryVal)
 			if xCanary {
-				s.serveCanary(w, req)
+				s.serveCanary(w, req, s.defaultCanary())
 			} else {
 				s.serveMain(w, req)
 			}
@@ -216,23 +410,44 @@ func (s *Server) viaProxy() http.HandlerFunc {
 }
 
 func (s *Server) serveMain(w http.ResponseWriter, req *http.Request) {
-	defer s.recordMetricTarget(req.Context(), "main")
+	s.forwardMain(w, req, s.isShadowEnabled())
+}
+
+// forwardMain forwards request to main, and mirrors it to the shadow target if mirror is set
+func (s *Server) forwardMain(w http.ResponseWriter, req *http.Request, mirror bool) {
+	defer s.recordMetricTarget(req.Context(), TargetMain)
+	defer s.recordMainLatency(req.Context())
 
 	if log.IsLevelEnabled(log.DebugLevel) {
-		s.logRequest("main", req)
+		s.logRequest(TargetMain, req)
+	}
+
+	s.pinAffinity(w, req, TargetMain)
+
+	if mirror {
+		s.shadow.serve(w, req, s.mainProxy)
+		return
 	}
 
 	s.mainProxy.ServeHTTP(w, req)
 }
 
-func (s *Server) serveCanary(w http.ResponseWriter, req *http.Request) {
-	defer s.recordMetricTarget(req.Context(), "canary")
+func (s *Server) serveCanary(w http.ResponseWriter, req *http.Request, target *canaryTarget) {
+	if s.isFallbackEligible(req) {
+		s.serveCanaryWithFallback(w, req, target)
+		return
+	}
+
+	defer s.recordMetricTarget(req.Context(), target.name)
+	defer target.recordLatency(req.Context())
 
 	if log.IsLevelEnabled(log.DebugLevel) {
-		s.logRequest("canary", req)
+		s.logRequest(target.name, req)
 	}
 
-	s.canaryProxy.ServeHTTP(w, req)
+	s.pinAffinity(w, req, target.name)
+
+	target.proxy.ServeHTTP(w, s.mutatedRequest(req))
 }
 
 func (s *Server) logRequest(target string, req *http.Request) {
@@ -244,79 +459,135 @@ func (s *Server) logRequest(target string, req *http.Request) {
 	}
 }
 
-func (s *Server) callSidecar(req *http.Request) (int, error) {
-	// Duplicate reader so that the original req.Body can still be used throughout
-	// the request
-	var bodyBuffer bytes.Buffer
-	body := io.TeeReader(req.Body, &bodyBuffer)
-
-	defer func() {
-		req.Body = ioutil.NopCloser(&bodyBuffer)
-	}()
+// canaryLimitReason returns the reason why none of the canary targets may receive any more request,
+// or false if at least one of them has not reached its circuit breaker limits yet
+func (s *Server) canaryLimitReason() (string, bool) {
+	for _, target := range s.canaryTargets {
+		if _, limited := target.limitReason(); !limited {
+			return "", false
+		}
+	}
 
-	ctx := req.Context()
-	outreq := req.WithContext(ctx)
+	return s.defaultCanary().limitReason()
+}
 
-	outBody, err := ioutil.ReadAll(body)
-	if err != nil {
-		return 0, err
+// serveCanaryWithinLimit forwards request to the canary target, unless one of its circuit breaker limits
+// has been reached in the meantime, in which case it will be forwarded to main instead. The client is not
+// pinned to main then, as the limits are only temporary.
+func (s *Server) serveCanaryWithinLimit(w http.ResponseWriter, req *http.Request, target *canaryTarget, reason string) {
+	if limitReason, limited := target.limitReason(); limited {
+		req = setRoutingReason(req, "%s, but %s", reason, limitReason)
+		s.serveMain(w, clearAffinityEligible(req))
+		return
 	}
-	outreq.Body = ioutil.NopCloser(bytes.NewReader(outBody))
 
-	recorder := httptest.NewRecorder()
-	s.sidecarProxy.ServeHTTP(recorder, outreq)
+	if !target.acquireInflight() {
+		req = setRoutingReason(req, "%s, but %s", reason, target.describe("max in-flight requests reached"))
+		s.serveMain(w, clearAffinityEligible(req))
+		return
+	}
+	defer target.releaseInflight()
 
-	if recorder.Code == StatusSidecarError {
-		return recorder.Code, errors.New(recorder.Body.String())
+	req, ok := target.takeRequest(req)
+	if !ok {
+		req = setRoutingReason(req, "%s, but canary limit reached", reason)
+		s.serveMain(w, clearAffinityEligible(req))
+		return
 	}
 
-	return recorder.Code, nil
+	req = setRoutingReason(req, reason)
+	s.serveCanary(w, req, target)
 }
 
 func (s *Server) viaProxyWithSidecar() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, req *http.Request) {
-		if s.IsCanaryRequestLimited() && s.canaryRequestLimitBucket.Available() <= 0 {
-			req = setRoutingReason(req, "Canary request limit reached")
+		if reason, limited := s.canaryLimitReason(); limited {
+			req = setRoutingReason(req, reason)
 
 			s.serveMain(w, req)
 			return
 		}
 
-		if s.IsCanaryErrorLimited() && s.canaryErrorLimitBucket.Available() <= 0 {
-			// log.Printf("Error reached")
-			req = setRoutingReason(req, "Canary error limit reached")
+		d, err := s.decide(req)
+		if err != nil {
+			if err != errSidecarBreakerOpen {
+				log.Print(fmt.Errorf("Error when calling sidecar: %v", err))
+			}
+
+			s.serveSidecarFailure(w, req, err)
+			return
+		}
+
+		if d.Target == TargetMain {
+			if s.isMutationEnabled() {
+				s.mutation.apply(req, d)
+			}
 
+			req = markAffinityEligible(req)
+			req = setRoutingReason(req, d.Reason)
 			s.serveMain(w, req)
 			return
 		}
 
-		statusCode, err := s.callSidecar(req)
-		if err != nil {
-			req = setRoutingReason(req, err.Error())
-			log.Print(fmt.Errorf("Error when calling sidecar: %v", err))
+		target, ok := s.canaryTargets[d.Target]
+		if !ok {
+			err = newSidecarError(sidecarReasonBadResponse, errors.Errorf("Sidecar returns unknown target %s", d.Target))
+			log.Print(err)
+
+			s.serveSidecarFailure(w, req, err)
+			return
+		}
+
+		// NOTE: The mutations are only applied once the request is forwarded to canary, as it may still be
+		// served by main because of the canary limits or of a fallback
+		req = markAffinityEligible(req)
+		req = withMutation(req, d)
+		s.serveCanaryWithinLimit(w, req, target, d.Reason)
+	}
+}
+
+func (s *Server) viaProxyWithSplit() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if reason, limited := s.defaultCanary().limitReason(); limited {
+			req = setRoutingReason(req, reason)
 
 			s.serveMain(w, req)
 			return
 		}
 
-		switch statusCode {
-		case StatusCodeMain:
-			req = setRoutingReason(req, "Sidecar returns status code %d", statusCode)
+		toCanary, err := s.splitter.toCanary(req)
+		if err != nil {
+			req = setRoutingReason(req, "Split (%s) %v", s.splitter.mode, err)
 			s.serveMain(w, req)
-		case StatusCodeCanary:
-			if s.IsCanaryRequestLimited() && s.canaryRequestLimitBucket.TakeAvailable(1) == 0 {
-				req = setRoutingReason(req, "Sidecar returns status code %d, but canary limit reached", statusCode)
-				s.serveMain(w, req)
-			} else {
-				req = setRoutingReason(req, "Sidecar returns status code %d", statusCode)
-				s.serveCanary(w, req)
-			}
-		default:
-			req = setRoutingReason(req, "Sidecar returns non standard status code %d", statusCode)
+			return
+		}
+
+		req = markAffinityEligible(req)
+
+		if !toCanary {
+			req = setRoutingReason(req, "Split (%s) selects main", s.splitter.mode)
 			s.serveMain(w, req)
+			return
 		}
+
+		s.serveCanaryWithinLimit(w, req, s.defaultCanary(), fmt.Sprintf("Split (%s) selects canary", s.splitter.mode))
+	}
+}
+
+// isTrue returns whether the optional configuration value b is set to true
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// valueOf returns the optional configuration value f, 0 if it is not set
+func valueOf(f *float64) float64 {
+	if f == nil {
+		return 0
 	}
+
+	return *f
 }
 
 func convertToBool(boolStr string) (bool, error) {
@@ -341,6 +612,22 @@ func setRoutingReason(req *http.Request, reason string, reasonArg ...interface{}
 	return req.WithContext(ctx)
 }
 
+// metricContext returns a context tagged with the version and route of the server, for metrics
+// recorded outside of request handling
+func (s *Server) metricContext() context.Context {
+	ctx, err := instrumentation.AddVersionTag(context.Background(), s.version)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	ctx, err = instrumentation.AddRouteTag(ctx, s.route)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	return ctx
+}
+
 func (s *Server) recordMetricTarget(ctx context.Context, target string) {
 	ctx, err := instrumentation.AddTargetTag(ctx, target)
 	if err != nil {
@@ -355,6 +642,17 @@ func (s *Server) recordMetricTarget(ctx context.Context, target string) {
 	instrumentation.RecordLatency(ctx)
 }
 
+// recordMainLatency feeds the main latency compared against by the canary latency ratio limits
+func (s *Server) recordMainLatency(ctx context.Context) {
+	if s.mainLatencyWindow == nil {
+		return
+	}
+
+	if latency, ok := instrumentation.Latency(ctx); ok {
+		s.mainLatencyWindow.record(latency, time.Now())
+	}
+}
+
 func trimRequestPathPrefix(reqURL *url.URL, prefix string) string {
 	return strings.TrimPrefix(reqURL.Path, prefix)
 }
@@ -1,17 +1,27 @@
 package canaryrouter
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/sidecarpb"
 )
 
 type restRequest struct {
@@ -242,6 +252,1186 @@ func Test_Server_integration(t *testing.T) {
 			}
 
 		})
+
+		t.Run("error-rate-canary", func(t *testing.T) {
+			backendCanaryWithErrorBody := "Hello, I'm Canary (but broken)!"
+			backendCanaryWithError, _ := setupServer(t, []byte(backendCanaryWithErrorBody), http.StatusInternalServerError, func(r *http.Request) {})
+			defer backendCanaryWithError.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanaryWithError.URL,
+				Split:        config.Split{CanaryWeight: config.Float64(100)},
+				CircuitBreaker: config.CircuitBreaker{
+					Mode:               CircuitBreakerModeErrorRate,
+					ErrorRateThreshold: 50,
+					MinRequests:        10,
+				},
+			}))
+			defer thisRouter.Close()
+
+			gotCanaryCount := 0
+			for i := 0; i < 30; i++ {
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) == backendCanaryWithErrorBody {
+					gotCanaryCount++
+				}
+			}
+
+			if gotCanaryCount != 10 {
+				t.Errorf("gotCanaryCount:%d, want 10 (min-requests)", gotCanaryCount)
+			}
+		})
+
+		t.Run("latency-threshold", func(t *testing.T) {
+			backendSlowCanary, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+			})
+			defer backendSlowCanary.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:     backendMain.URL,
+				CanaryTarget:   backendSlowCanary.URL,
+				Split:          config.Split{CanaryWeight: config.Float64(100)},
+				CircuitBreaker: config.CircuitBreaker{LatencyThreshold: 20, MinRequests: 3},
+			}))
+			defer thisRouter.Close()
+
+			gotCanaryCount := 0
+			for i := 0; i < 10; i++ {
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) == backendCanaryBody {
+					gotCanaryCount++
+				}
+			}
+
+			// NOTE: The latency is recorded once the response has been sent, so the next request may
+			// still be forwarded to canary
+			if gotCanaryCount < 3 || gotCanaryCount > 4 {
+				t.Errorf("gotCanaryCount:%d, want 3 (min-requests)", gotCanaryCount)
+			}
+		})
+
+		t.Run("max-inflight-canary", func(t *testing.T) {
+			arrived := make(chan struct{})
+			release := make(chan struct{})
+			backendSlowCanary, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) {
+				arrived <- struct{}{}
+				<-release
+			})
+			defer backendSlowCanary.Close()
+
+			sideCarServerAlwaysCanary, _ := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {})
+			defer sideCarServerAlwaysCanary.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:     backendMain.URL,
+				CanaryTarget:   backendSlowCanary.URL,
+				SidecarURL:     sideCarServerAlwaysCanary.URL,
+				CircuitBreaker: config.CircuitBreaker{MaxInflightCanary: 2},
+			}))
+			defer thisRouter.Close()
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) != backendCanaryBody {
+						t.Errorf("Not forwarded to Canary. Gotbody: %s", string(gotBody))
+					}
+				}()
+				<-arrived
+			}
+
+			if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) != backendMainBody {
+				t.Errorf("Overflow not forwarded to Main. Gotbody: %s", string(gotBody))
+			}
+
+			close(release)
+			wg.Wait()
+
+			go func() { <-arrived }()
+			if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) != backendCanaryBody {
+				t.Errorf("Not forwarded to Canary once in-flight requests are done. Gotbody: %s", string(gotBody))
+			}
+		})
+	})
+	t.Run("shadow", func(t *testing.T) {
+		mirrored := make(chan string, 1)
+		backendShadowCanary, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			mirrored <- r.URL.Path + " " + string(body)
+		})
+		defer backendShadowCanary.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendShadowCanary.URL,
+			Shadow:       config.Shadow{SampleRate: config.Float64(100)},
+		}))
+		defer thisRouter.Close()
+
+		restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodPost, targetURL: thisRouter.URL + "/foo/bar", bodyPayload: "foo bar body"}
+		if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) != backendMainBody {
+			t.Errorf("Not forwarded to Main. Gotbody: %s", string(gotBody))
+		}
+
+		select {
+		case got := <-mirrored:
+			if got != "/foo/bar foo bar body" {
+				t.Errorf("Mirrored request = %q, want %q", got, "/foo/bar foo bar body")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Not mirrored to Canary")
+		}
+	})
+
+	t.Run("shadow diff", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "shadow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		backendShadowCanary, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) {})
+		defer backendShadowCanary.Close()
+
+		logFile := filepath.Join(dir, "diff.log")
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendShadowCanary.URL,
+			Shadow:       config.Shadow{SampleRate: config.Float64(100), Diff: config.ShadowDiff{Enabled: config.Bool(true), LogFile: logFile}},
+		}))
+		defer thisRouter.Close()
+
+		restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+		if _, gotBody := restClientCall(t, thisRouter.Client(), restRequest); string(gotBody) != backendMainBody {
+			t.Errorf("Not forwarded to Main. Gotbody: %s", string(gotBody))
+		}
+
+		var got []byte
+		for deadline := time.Now().Add(time.Second); len(got) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			got, _ = ioutil.ReadFile(logFile)
+		}
+
+		if !strings.Contains(string(got), `"mismatch":"body"`) || !strings.Contains(string(got), `"path":"/foo/bar"`) {
+			t.Errorf("Mismatch sample = %s, want a body mismatch of /foo/bar", string(got))
+		}
+	})
+
+	t.Run("shadow diff upgrade", func(t *testing.T) {
+		backendUpgrade := setupUpgradeServer(t)
+		defer backendUpgrade.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendUpgrade.URL,
+			CanaryTarget: backendCanary.URL,
+			Shadow:       config.Shadow{SampleRate: config.Float64(100), Diff: config.ShadowDiff{Enabled: config.Bool(true)}},
+		}))
+		defer thisRouter.Close()
+
+		if gotStatus, gotLine := upgradeCall(t, thisRouter.URL); gotStatus != http.StatusSwitchingProtocols || gotLine != "hello\n" {
+			t.Errorf("Upgrade not forwarded to Main. Got status %d and line %q", gotStatus, gotLine)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		backendCanaryDown := httptest.NewServer(http.NotFoundHandler())
+		backendCanaryDown.Close()
+
+		backendCanaryUnavailableBody := "Hello, I'm Canary (but unavailable)!"
+		backendCanaryUnavailable, _ := setupServer(t, []byte(backendCanaryUnavailableBody), http.StatusServiceUnavailable, func(r *http.Request) {})
+		defer backendCanaryUnavailable.Close()
+
+		tests := []struct {
+			name       string
+			canaryURL  string
+			method     string
+			wantStatus int
+			wantBody   string
+		}{
+			{name: "connection error on GET falls back to main", canaryURL: backendCanaryDown.URL, method: http.MethodGet, wantStatus: http.StatusOK, wantBody: backendMainBody},
+			{name: "connection error on PUT falls back to main", canaryURL: backendCanaryDown.URL, method: http.MethodPut, wantStatus: http.StatusOK, wantBody: backendMainBody},
+			{name: "connection error on POST does not fall back", canaryURL: backendCanaryDown.URL, method: http.MethodPost, wantStatus: http.StatusBadGateway, wantBody: ""},
+			{name: "fallback status code on GET falls back to main", canaryURL: backendCanaryUnavailable.URL, method: http.MethodGet, wantStatus: http.StatusOK, wantBody: backendMainBody},
+			{name: "fallback status code on POST does not fall back", canaryURL: backendCanaryUnavailable.URL, method: http.MethodPost, wantStatus: http.StatusServiceUnavailable, wantBody: backendCanaryUnavailableBody},
+			{name: "canary success is not retried", canaryURL: backendCanary.URL, method: http.MethodGet, wantStatus: http.StatusOK, wantBody: backendCanaryBody},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+					MainTarget:   backendMain.URL,
+					CanaryTarget: tt.canaryURL,
+					Split:        config.Split{CanaryWeight: config.Float64(100)},
+					Fallback:     config.Fallback{Enabled: config.Bool(true), StatusCodes: []int{http.StatusServiceUnavailable}},
+				}))
+				defer thisRouter.Close()
+
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: tt.method, targetURL: thisRouter.URL + "/foo/bar", bodyPayload: "foo bar body"}
+				gotResp, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if gotResp.StatusCode != tt.wantStatus || string(gotBody) != tt.wantBody {
+					t.Errorf("Got %d %q, want %d %q", gotResp.StatusCode, string(gotBody), tt.wantStatus, tt.wantBody)
+				}
+			})
+		}
+
+		t.Run("fallback to main is not mirrored", func(t *testing.T) {
+			var canaryHits int32
+			backendCanaryCounting, _ := setupServer(t, emptyBodyBytes, http.StatusServiceUnavailable, func(r *http.Request) { atomic.AddInt32(&canaryHits, 1) })
+			defer backendCanaryCounting.Close()
+
+			s := setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanaryCounting.URL,
+				Split:        config.Split{CanaryWeight: config.Float64(100)},
+				Fallback:     config.Fallback{Enabled: config.Bool(true), StatusCodes: []int{http.StatusServiceUnavailable}},
+				Shadow:       config.Shadow{SampleRate: config.Float64(100)},
+			})
+			thisRouter := httptest.NewServer(s)
+			defer thisRouter.Close()
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodPut, targetURL: thisRouter.URL + "/foo/bar", bodyPayload: "foo bar body"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Not fallen back to Main. Gotbody: %s", string(gotBody))
+			}
+
+			// NOTE: Closing the server waits for the mirrored requests to be sent
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := atomic.LoadInt32(&canaryHits); got != 1 {
+				t.Errorf("Canary should be called once, got %d calls", got)
+			}
+		})
+
+		t.Run("upgrade request is forwarded to canary", func(t *testing.T) {
+			backendCanaryUpgrade := setupUpgradeServer(t)
+			defer backendCanaryUpgrade.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanaryUpgrade.URL,
+				Split:        config.Split{CanaryWeight: config.Float64(100)},
+				Fallback:     config.Fallback{Enabled: config.Bool(true), StatusCodes: []int{http.StatusServiceUnavailable}},
+			}))
+			defer thisRouter.Close()
+
+			if gotStatus, gotLine := upgradeCall(t, thisRouter.URL); gotStatus != http.StatusSwitchingProtocols || gotLine != "hello\n" {
+				t.Errorf("Upgrade not forwarded to Canary. Got status %d and line %q", gotStatus, gotLine)
+			}
+		})
+	})
+
+	t.Run("split", func(t *testing.T) {
+		t.Run("deterministic canary-weight", func(t *testing.T) {
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanary.URL,
+				Split:        config.Split{CanaryWeight: config.Float64(30), Mode: SplitModeDeterministic},
+			}))
+			defer thisRouter.Close()
+
+			totalRequest := 100
+			var listRestRequest []restRequest
+			for i := 1; i <= totalRequest; i++ {
+				listRestRequest = append(listRestRequest, restRequest{httpHeader: http.Header{}, httpMethod: http.MethodPost, targetURL: thisRouter.URL + "/foo/bar", bodyPayload: fmt.Sprintf("%d", i)})
+			}
+
+			gotMainCount, gotCanaryCount := restClientCallConcurrentlyToMainAndCanary(t, thisRouter.Client(), backendMainBody, backendCanaryBody, listRestRequest)
+
+			if gotCanaryCount != 30 || gotMainCount != 70 {
+				t.Errorf("gotCanaryCount:%d gotMainCount:%d", gotCanaryCount, gotMainCount)
+			}
+		})
+
+		t.Run("respects request-limit-canary", func(t *testing.T) {
+			canaryRequestLimit := uint64(10)
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:     backendMain.URL,
+				CanaryTarget:   backendCanary.URL,
+				Split:          config.Split{CanaryWeight: config.Float64(100)},
+				CircuitBreaker: config.CircuitBreaker{RequestLimitCanary: canaryRequestLimit},
+			}))
+			defer thisRouter.Close()
+
+			totalRequest := 50
+			var listRestRequest []restRequest
+			for i := 1; i <= totalRequest; i++ {
+				listRestRequest = append(listRestRequest, restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"})
+			}
+
+			gotMainCount, gotCanaryCount := restClientCallConcurrentlyToMainAndCanary(t, thisRouter.Client(), backendMainBody, backendCanaryBody, listRestRequest)
+
+			if uint64(gotCanaryCount) != canaryRequestLimit || gotMainCount != totalRequest-gotCanaryCount {
+				t.Errorf("gotCanaryCount:%d gotMainCount:%d canaryRequestLimit:%d", gotCanaryCount, gotMainCount, canaryRequestLimit)
+			}
+		})
+
+		t.Run("ignored when sidecar is provided", func(t *testing.T) {
+			sideCarToMain, sideCarToMainURL := setupServer(t, emptyBodyBytes, StatusCodeMain, func(r *http.Request) {})
+			defer sideCarToMain.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanary.URL,
+				SidecarURL:   sideCarToMainURL.String(),
+				Split:        config.Split{CanaryWeight: config.Float64(100)},
+			}))
+			defer thisRouter.Close()
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Not forwarded to Main. Gotbody: %s", string(gotBody))
+			}
+		})
+	})
+
+	t.Run("sidecar cache", func(t *testing.T) {
+		var sidecarHits int32
+		sideCarToCanary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&sidecarHits, 1)
+			w.WriteHeader(StatusCodeCanary)
+		}))
+		defer sideCarToCanary.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			SidecarURL:   sideCarToCanary.URL,
+			SidecarCache: config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}}},
+		}))
+		defer thisRouter.Close()
+
+		customerIDs := []string{"1", "2", "1", "1", "2", ""}
+		for i, customerID := range customerIDs {
+			header := http.Header{}
+			if customerID != "" {
+				header.Set("X-Customer-Id", customerID)
+			}
+
+			restRequest := restRequest{httpHeader: header, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendCanaryBody {
+				t.Errorf("Request #%d Gotbody: %s Wantbody: %s", i, string(gotBody), backendCanaryBody)
+			}
+		}
+
+		// once per customer, and once for the request without customer
+		if got := atomic.LoadInt32(&sidecarHits); got != 3 {
+			t.Errorf("Sidecar should be called once per cache key, got %d calls", got)
+		}
+	})
+
+	t.Run("sidecar mutation", func(t *testing.T) {
+		var gotTenantID, gotAuthorization, gotPath string
+		backendTenant, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) {
+			gotTenantID, gotAuthorization, gotPath = r.Header.Get("X-Tenant-Id"), r.Header.Get("Authorization"), r.URL.Path
+		})
+		defer backendTenant.Close()
+
+		sideCarMutating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Add(HeaderSetHeader, "X-Tenant-Id: 42")
+			w.Header().Add(HeaderSetHeader, "Authorization: forged")
+			w.Header().Set(HeaderRewritePath, "/tenants/42"+req.URL.Path)
+			w.WriteHeader(StatusCodeCanary)
+		}))
+		defer sideCarMutating.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:      backendMain.URL,
+			CanaryTarget:    backendTenant.URL,
+			SidecarURL:      sideCarMutating.URL,
+			SidecarMutation: config.SidecarMutation{Headers: []string{"X-Tenant-Id"}, RewritePath: config.Bool(true)},
+		}))
+		defer thisRouter.Close()
+
+		header := http.Header{}
+		header.Set("Authorization", "secret")
+		restRequest := restRequest{httpHeader: header, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+		_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+		if string(gotBody) != backendCanaryBody {
+			t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), backendCanaryBody)
+		}
+
+		if gotTenantID != "42" || gotAuthorization != "secret" || gotPath != "/tenants/42/foo/bar" {
+			t.Errorf("Got X-Tenant-Id %q, Authorization %q and path %q", gotTenantID, gotAuthorization, gotPath)
+		}
+	})
+
+	t.Run("sidecar mutation with fallback", func(t *testing.T) {
+		var gotCanaryPath, gotMainPath, gotMainTenantID string
+		backendCanaryUnavailable, _ := setupServer(t, emptyBodyBytes, http.StatusServiceUnavailable, func(r *http.Request) { gotCanaryPath = r.URL.Path })
+		defer backendCanaryUnavailable.Close()
+
+		backendMainRecording, _ := setupServer(t, []byte(backendMainBody), http.StatusOK, func(r *http.Request) {
+			gotMainPath, gotMainTenantID = r.URL.Path, r.Header.Get("X-Tenant-Id")
+		})
+		defer backendMainRecording.Close()
+
+		sideCarMutating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Add(HeaderSetHeader, "X-Tenant-Id: 42")
+			w.Header().Set(HeaderRewritePath, "/tenants/42"+req.URL.Path)
+			w.WriteHeader(StatusCodeCanary)
+		}))
+		defer sideCarMutating.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:      backendMainRecording.URL,
+			CanaryTarget:    backendCanaryUnavailable.URL,
+			SidecarURL:      sideCarMutating.URL,
+			SidecarMutation: config.SidecarMutation{Headers: []string{"X-Tenant-Id"}, RewritePath: config.Bool(true)},
+			Fallback:        config.Fallback{Enabled: config.Bool(true), StatusCodes: []int{http.StatusServiceUnavailable}},
+		}))
+		defer thisRouter.Close()
+
+		restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+		_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+		if string(gotBody) != backendMainBody {
+			t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), backendMainBody)
+		}
+
+		if gotCanaryPath != "/tenants/42/foo/bar" {
+			t.Errorf("Mutation not applied to Canary. Got path %q", gotCanaryPath)
+		}
+		if gotMainPath != "/foo/bar" || gotMainTenantID != "" {
+			t.Errorf("Mutation applied to Main. Got path %q and X-Tenant-Id %q", gotMainPath, gotMainTenantID)
+		}
+	})
+
+	t.Run("sidecar mutation with cache", func(t *testing.T) {
+		var gotPath string
+		backendTenant, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) { gotPath = r.URL.Path })
+		defer backendTenant.Close()
+
+		sideCarMutating := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(HeaderRewritePath, "/tenants/42"+req.URL.Path)
+			w.WriteHeader(StatusCodeCanary)
+		}))
+		defer sideCarMutating.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:      backendMain.URL,
+			CanaryTarget:    backendTenant.URL,
+			SidecarURL:      sideCarMutating.URL,
+			SidecarCache:    config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}}},
+			SidecarMutation: config.SidecarMutation{RewritePath: config.Bool(true)},
+		}))
+		defer thisRouter.Close()
+
+		for _, path := range []string{"/foo/bar", "/foo/baz"} {
+			header := http.Header{}
+			header.Set("X-Customer-Id", "1")
+			restRequest := restRequest{httpHeader: header, httpMethod: http.MethodGet, targetURL: thisRouter.URL + path}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendCanaryBody {
+				t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), backendCanaryBody)
+			}
+
+			if wantPath := "/tenants/42" + path; gotPath != wantPath {
+				t.Errorf("Got path %q, want %q", gotPath, wantPath)
+			}
+		}
+	})
+
+	t.Run("sidecar json protocol", func(t *testing.T) {
+		var gotTenantID string
+		backendTenant, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) { gotTenantID = r.Header.Get("X-Tenant-Id") })
+		defer backendTenant.Close()
+
+		sideCarJSON := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/main":
+				_, _ = w.Write([]byte(`{"target": "main", "reason": "regular user"}`))
+			case "/canary":
+				_, _ = w.Write([]byte(`{"target": "canary", "reason": "beta tester", "set-headers": {"X-Tenant-Id": "42"}}`))
+			case "/unknown":
+				_, _ = w.Write([]byte(`{"target": "gamma"}`))
+			default:
+				w.WriteHeader(StatusCodeCanary)
+			}
+		}))
+		defer sideCarJSON.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:      backendMain.URL,
+			CanaryTarget:    backendTenant.URL,
+			SidecarURL:      sideCarJSON.URL,
+			SidecarProtocol: SidecarProtocolJSON,
+			SidecarMutation: config.SidecarMutation{Headers: []string{"X-Tenant-Id"}},
+		}))
+		defer thisRouter.Close()
+
+		testCases := []struct {
+			path     string
+			wantBody string
+		}{
+			{path: "/main", wantBody: backendMainBody},
+			{path: "/canary", wantBody: backendCanaryBody},
+			{path: "/unknown", wantBody: backendMainBody},
+			{path: "/empty", wantBody: backendMainBody},
+		}
+
+		for _, tc := range testCases {
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + tc.path}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != tc.wantBody {
+				t.Errorf("%s Gotbody: %s Wantbody: %s", tc.path, string(gotBody), tc.wantBody)
+			}
+		}
+
+		if gotTenantID != "42" {
+			t.Errorf("Got X-Tenant-Id %q, want %q", gotTenantID, "42")
+		}
+	})
+
+	t.Run("grpc sidecar", func(t *testing.T) {
+		sideCarGRPC, sideCarGRPCURL := setupGRPCSidecar(t, func(ctx context.Context, in *sidecarpb.DecideRequest) (*sidecarpb.DecideResponse, error) {
+			if in.Path == "/canary" {
+				return &sidecarpb.DecideResponse{Target: TargetCanary}, nil
+			}
+			return &sidecarpb.DecideResponse{Target: TargetMain}, nil
+		})
+		defer sideCarGRPC.Stop()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			SidecarURL:   sideCarGRPCURL,
+		}))
+		defer thisRouter.Close()
+
+		testCases := []struct {
+			path     string
+			wantBody string
+		}{
+			{path: "/canary", wantBody: backendCanaryBody},
+			{path: "/main", wantBody: backendMainBody},
+		}
+
+		for _, tc := range testCases {
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + tc.path}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != tc.wantBody {
+				t.Errorf("%s Gotbody: %s Wantbody: %s", tc.path, string(gotBody), tc.wantBody)
+			}
+		}
+	})
+
+	t.Run("sidecar body", func(t *testing.T) {
+		var gotSidecarBody, gotCanaryBody string
+		backendEcho, _ := setupServer(t, []byte(backendCanaryBody), http.StatusOK, func(r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			gotCanaryBody = string(body)
+		})
+		defer backendEcho.Close()
+
+		sideCarToCanary, sideCarToCanaryURL := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			gotSidecarBody = string(body)
+		})
+		defer sideCarToCanary.Close()
+
+		testCases := []struct {
+			name            string
+			sidecarBody     config.SidecarBody
+			sidecarFailure  config.SidecarFailure
+			wantBody        string
+			wantSidecarBody string
+		}{
+			{name: "headers", sidecarBody: config.SidecarBody{Mode: SidecarBodyHeaders}, wantBody: backendCanaryBody, wantSidecarBody: ""},
+			{name: "prefix", sidecarBody: config.SidecarBody{Mode: SidecarBodyPrefix, PrefixSize: 6}, wantBody: backendCanaryBody, wantSidecarBody: "type=2"},
+			{name: "max size exceeded", sidecarBody: config.SidecarBody{MaxSize: 6}, wantBody: backendMainBody, wantSidecarBody: ""},
+			{
+				name:            "max size exceeded with reject policy",
+				sidecarBody:     config.SidecarBody{MaxSize: 6},
+				sidecarFailure:  config.SidecarFailure{Policy: SidecarFailureReject},
+				wantBody:        backendMainBody,
+				wantSidecarBody: "",
+			},
+			{
+				name:            "max size exceeded with canary policy",
+				sidecarBody:     config.SidecarBody{MaxSize: 6},
+				sidecarFailure:  config.SidecarFailure{Policy: SidecarFailureCanary},
+				wantBody:        backendMainBody,
+				wantSidecarBody: "",
+			},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				gotSidecarBody, gotCanaryBody = "", ""
+
+				thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+					MainTarget:     backendMain.URL,
+					CanaryTarget:   backendEcho.URL,
+					SidecarURL:     sideCarToCanaryURL.String(),
+					SidecarBody:    tc.sidecarBody,
+					SidecarFailure: tc.sidecarFailure,
+				}))
+				defer thisRouter.Close()
+
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodPost, targetURL: thisRouter.URL + "/foo/bar", bodyPayload: "type=2&upload=large"}
+				_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if string(gotBody) != tc.wantBody {
+					t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), tc.wantBody)
+				}
+
+				if gotSidecarBody != tc.wantSidecarBody {
+					t.Errorf("Got sidecar body %q, want %q", gotSidecarBody, tc.wantSidecarBody)
+				}
+				if tc.wantBody == backendCanaryBody && gotCanaryBody != "type=2&upload=large" {
+					t.Errorf("Got canary body %q, want the whole request body", gotCanaryBody)
+				}
+			})
+		}
+	})
+
+	t.Run("sidecar failure", func(t *testing.T) {
+		sideCarBadStatus, sideCarBadStatusURL := setupServer(t, emptyBodyBytes, http.StatusInternalServerError, func(r *http.Request) {})
+		defer sideCarBadStatus.Close()
+
+		sideCarClosed, sideCarClosedURL := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {})
+		sideCarClosed.Close()
+
+		sideCarUnknownTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(HeaderCanaryTarget, "gamma")
+			w.WriteHeader(StatusCodeCanary)
+		}))
+		defer sideCarUnknownTarget.Close()
+
+		testCases := []struct {
+			name           string
+			sidecarURL     string
+			sidecarFailure config.SidecarFailure
+			wantStatusCode int
+			wantBody       string
+		}{
+			{name: "bad status to main", sidecarURL: sideCarBadStatusURL.String(), wantStatusCode: http.StatusOK, wantBody: backendMainBody},
+			{name: "connection refused to main", sidecarURL: sideCarClosedURL.String(), wantStatusCode: http.StatusOK, wantBody: backendMainBody},
+			{
+				name:           "bad status to canary",
+				sidecarURL:     sideCarBadStatusURL.String(),
+				sidecarFailure: config.SidecarFailure{Policy: SidecarFailureCanary},
+				wantStatusCode: http.StatusOK,
+				wantBody:       backendCanaryBody,
+			},
+			{
+				name:           "connection refused rejected",
+				sidecarURL:     sideCarClosedURL.String(),
+				sidecarFailure: config.SidecarFailure{Policy: SidecarFailureReject, StatusCode: http.StatusBadGateway},
+				wantStatusCode: http.StatusBadGateway,
+			},
+			{
+				name:           "unknown target rejected",
+				sidecarURL:     sideCarUnknownTarget.URL,
+				sidecarFailure: config.SidecarFailure{Policy: SidecarFailureReject},
+				wantStatusCode: http.StatusServiceUnavailable,
+			},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+					MainTarget:     backendMain.URL,
+					CanaryTarget:   backendCanary.URL,
+					SidecarURL:     tc.sidecarURL,
+					SidecarFailure: tc.sidecarFailure,
+				}))
+				defer thisRouter.Close()
+
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				gotResp, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if gotResp.StatusCode != tc.wantStatusCode {
+					t.Errorf("Got status code %d, want %d", gotResp.StatusCode, tc.wantStatusCode)
+				}
+				if tc.wantBody != "" && string(gotBody) != tc.wantBody {
+					t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), tc.wantBody)
+				}
+			})
+		}
+	})
+
+	t.Run("sidecar circuit breaker", func(t *testing.T) {
+		var sidecarHits int32
+		sideCarBroken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&sidecarHits, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer sideCarBroken.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:     backendMain.URL,
+			CanaryTarget:   backendCanary.URL,
+			SidecarURL:     sideCarBroken.URL,
+			SidecarBreaker: config.SidecarBreaker{FailureThreshold: 3, CoolDown: 60},
+		}))
+		defer thisRouter.Close()
+
+		for i := 0; i < 10; i++ {
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Request #%d Gotbody: %s Wantbody: %s", i, string(gotBody), backendMainBody)
+			}
+		}
+
+		if got := atomic.LoadInt32(&sidecarHits); got != 3 {
+			t.Errorf("Sidecar should be skipped once the breaker is open, got %d calls", got)
+		}
+	})
+
+	t.Run("sidecar urls", func(t *testing.T) {
+		sideCarToCanary, sideCarToCanaryURL := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {})
+		defer sideCarToCanary.Close()
+
+		sideCarClosed, sideCarClosedURL := setupServer(t, emptyBodyBytes, StatusCodeMain, func(r *http.Request) {})
+		sideCarClosed.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			SidecarURLs:  []string{sideCarClosedURL.String(), sideCarToCanaryURL.String()},
+		}))
+		defer thisRouter.Close()
+
+		for i := 0; i < 6; i++ {
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodPost, targetURL: thisRouter.URL + "/foo/bar", bodyPayload: "type=2"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendCanaryBody {
+				t.Errorf("Request #%d not retried on the available sidecar. Gotbody: %s", i, string(gotBody))
+			}
+		}
+	})
+
+	t.Run("decider", func(t *testing.T) {
+		decider := DeciderFunc(func(req *http.Request) (*Decision, error) {
+			switch req.Header.Get("X-Beta") {
+			case "":
+				return &Decision{Target: TargetMain, Reason: "Not a beta user"}, nil
+			case "error":
+				return nil, errors.New("decider failure")
+			default:
+				return &Decision{Target: TargetCanary, Reason: "Beta user"}, nil
+			}
+		})
+
+		s, err := NewServer(config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			Routes:       []config.Route{{PathPrefix: "/orders"}},
+		}, "some-version", WithDecider(decider))
+		if err != nil {
+			t.Fatal(errors.ErrorStack(err))
+		}
+
+		thisRouter := httptest.NewServer(s)
+		defer thisRouter.Close()
+
+		tests := []struct {
+			name     string
+			path     string
+			beta     string
+			wantBody string
+		}{
+			{name: "main", path: "/foo/bar", wantBody: backendMainBody},
+			{name: "canary", path: "/foo/bar", beta: "1", wantBody: backendCanaryBody},
+			{name: "canary in route", path: "/orders/1", beta: "1", wantBody: backendCanaryBody},
+			{name: "error falls back to main", path: "/foo/bar", beta: "error", wantBody: backendMainBody},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				restRequest := restRequest{httpHeader: http.Header{"X-Beta": []string{tt.beta}}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + tt.path}
+				_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if string(gotBody) != tt.wantBody {
+					t.Errorf("Request not forwarded to the decided target. Gotbody: %s", string(gotBody))
+				}
+			})
+		}
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		stickyConfig := config.Sticky{SigningKey: "s3cr3t", CookieName: "affinity", TTL: 60}
+
+		// sidecar decides canary for the first request only, then main afterwards
+		var sidecarHits int32
+		sideCarCanaryOnce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&sidecarHits, 1) == 1 {
+				w.WriteHeader(StatusCodeCanary)
+			} else {
+				w.WriteHeader(StatusCodeMain)
+			}
+		}))
+		defer sideCarCanaryOnce.Close()
+
+		t.Run("pinned session survives sidecar decision changes", func(t *testing.T) {
+			atomic.StoreInt32(&sidecarHits, 0)
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanary.URL,
+				SidecarURL:   sideCarCanaryOnce.URL,
+				Sticky:       stickyConfig,
+			}))
+			defer thisRouter.Close()
+
+			client := thisRouter.Client()
+			jar, err := cookiejar.New(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Jar = jar
+
+			for i := 0; i < 5; i++ {
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				_, gotBody := restClientCall(t, client, restRequest)
+				if string(gotBody) != backendCanaryBody {
+					t.Errorf("Request #%d not forwarded to pinned Canary. Gotbody: %s", i, string(gotBody))
+				}
+			}
+
+			if got := atomic.LoadInt32(&sidecarHits); got != 1 {
+				t.Errorf("Sidecar should only be called once for pinned session, got %d calls", got)
+			}
+		})
+
+		t.Run("without cookie follows sidecar decision", func(t *testing.T) {
+			atomic.StoreInt32(&sidecarHits, 0)
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanary.URL,
+				SidecarURL:   sideCarCanaryOnce.URL,
+				Sticky:       stickyConfig,
+			}))
+			defer thisRouter.Close()
+
+			wantBodies := []string{backendCanaryBody, backendMainBody, backendMainBody}
+			for i, wantBody := range wantBodies {
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if string(gotBody) != wantBody {
+					t.Errorf("Request #%d Gotbody: %s Wantbody: %s", i, string(gotBody), wantBody)
+				}
+			}
+		})
+
+		t.Run("tampered cookie is ignored", func(t *testing.T) {
+			sideCarToMain, sideCarToMainURL := setupServer(t, emptyBodyBytes, StatusCodeMain, func(r *http.Request) {})
+			defer sideCarToMain.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanary.URL,
+				SidecarURL:   sideCarToMainURL.String(),
+				Sticky:       stickyConfig,
+			}))
+			defer thisRouter.Close()
+
+			forged, err := newAffinity(config.Sticky{SigningKey: "not-the-key", CookieName: "affinity", TTL: 60}, DefaultRouteName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			forgedCookie := forged.cookie("canary", time.Now())
+			restRequest := restRequest{httpHeader: http.Header{"Cookie": {forgedCookie.Name + "=" + forgedCookie.Value}}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Not forwarded to Main. Gotbody: %s", string(gotBody))
+			}
+		})
+
+		t.Run("canary overflow to main is not pinned", func(t *testing.T) {
+			canaryReached, canaryRelease := make(chan struct{}), make(chan struct{})
+			backendCanaryBlocking := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				canaryReached <- struct{}{}
+				<-canaryRelease
+				_, _ = w.Write([]byte(backendCanaryBody))
+			}))
+			defer backendCanaryBlocking.Close()
+
+			sideCarToCanary, sideCarToCanaryURL := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {})
+			defer sideCarToCanary.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:     backendMain.URL,
+				CanaryTarget:   backendCanaryBlocking.URL,
+				SidecarURL:     sideCarToCanaryURL.String(),
+				CircuitBreaker: config.CircuitBreaker{MaxInflightCanary: 1},
+				Sticky:         stickyConfig,
+			}))
+			defer thisRouter.Close()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				_, _ = restClientCall(t, thisRouter.Client(), restRequest)
+			}()
+			<-canaryReached
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			gotResp, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			close(canaryRelease)
+			<-done
+
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Overflow not forwarded to Main. Gotbody: %s", string(gotBody))
+			}
+			if gotCookies := gotResp.Cookies(); len(gotCookies) != 0 {
+				t.Errorf("Overflow to Main should not be pinned, got cookies %v", gotCookies)
+			}
+		})
+
+		t.Run("fallback to main is not pinned", func(t *testing.T) {
+			backendCanaryUnavailable, _ := setupServer(t, emptyBodyBytes, http.StatusServiceUnavailable, func(r *http.Request) {})
+			defer backendCanaryUnavailable.Close()
+
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanaryUnavailable.URL,
+				Split:        config.Split{CanaryWeight: config.Float64(100)},
+				Fallback:     config.Fallback{Enabled: config.Bool(true), StatusCodes: []int{http.StatusServiceUnavailable}},
+				Sticky:       stickyConfig,
+			}))
+			defer thisRouter.Close()
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			gotResp, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Not fallen back to Main. Gotbody: %s", string(gotBody))
+			}
+			if gotCookies := gotResp.Cookies(); len(gotCookies) != 0 {
+				t.Errorf("Fallback to Main should not be pinned, got cookies %v", gotCookies)
+			}
+		})
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		sideCarToCanary, sideCarToCanaryURL := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {})
+		defer sideCarToCanary.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			SidecarURL:   sideCarToCanaryURL.String(),
+			Rules: []config.Rule{
+				{Name: "orders", Target: RuleTargetCanary, Methods: []string{http.MethodPost}, Path: config.PathMatcher{Glob: "/orders/*"}},
+				{Name: "beta", Target: RuleTargetSidecar, Query: []config.ValueMatcher{{Name: "beta", Equals: "1"}}},
+				{Name: "default", Target: RuleTargetMain},
+			},
+		}))
+		defer thisRouter.Close()
+
+		testCases := []struct {
+			name     string
+			method   string
+			path     string
+			wantBody string
+		}{
+			{name: "first matching rule to canary", method: http.MethodPost, path: "/orders/42", wantBody: backendCanaryBody},
+			{name: "rule to sidecar", method: http.MethodGet, path: "/orders/42?beta=1", wantBody: backendCanaryBody},
+			{name: "catch all rule to main", method: http.MethodGet, path: "/orders/42", wantBody: backendMainBody},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				restRequest := restRequest{httpHeader: http.Header{}, httpMethod: tc.method, targetURL: thisRouter.URL + tc.path}
+				_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if string(gotBody) != tc.wantBody {
+					t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), tc.wantBody)
+				}
+			})
+		}
+	})
+
+	t.Run("targets", func(t *testing.T) {
+		backendBetaBody := "Hello, I'm Beta!"
+		backendBeta, _ := setupServer(t, []byte(backendBetaBody), http.StatusOK, func(r *http.Request) {})
+		defer backendBeta.Close()
+
+		// sidecar forwards to canary and selects the target from the X-Want-Target request header
+		sideCarSelectTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(HeaderCanaryTarget, req.Header.Get("X-Want-Target"))
+			w.WriteHeader(StatusCodeCanary)
+		}))
+		defer sideCarSelectTarget.Close()
+
+		betaRequestLimit := uint64(3)
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			SidecarURL:   sideCarSelectTarget.URL,
+			Targets: map[string]config.Target{
+				"Beta": {URL: backendBeta.URL, CircuitBreaker: config.CircuitBreaker{RequestLimitCanary: betaRequestLimit}},
+			},
+		}))
+		defer thisRouter.Close()
+
+		testCases := []struct {
+			name       string
+			wantTarget string
+			wantBody   string
+		}{
+			{name: "default canary target", wantTarget: "", wantBody: backendCanaryBody},
+			{name: "named target is case insensitive", wantTarget: "BETA", wantBody: backendBetaBody},
+			{name: "unknown target to main", wantTarget: "gamma", wantBody: backendMainBody},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				restRequest := restRequest{httpHeader: http.Header{"X-Want-Target": {tc.wantTarget}}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if string(gotBody) != tc.wantBody {
+					t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), tc.wantBody)
+				}
+			})
+		}
+
+		t.Run("each target has its own circuit breaker", func(t *testing.T) {
+			// one beta request has already been consumed above
+			for i := uint64(1); i < betaRequestLimit+3; i++ {
+				wantBody := backendBetaBody
+				if i >= betaRequestLimit {
+					wantBody = backendMainBody
+				}
+
+				restRequest := restRequest{httpHeader: http.Header{"X-Want-Target": {"beta"}}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+				_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+				if string(gotBody) != wantBody {
+					t.Errorf("Request #%d Gotbody: %s Wantbody: %s", i, string(gotBody), wantBody)
+				}
+			}
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/foo/bar"}
+			_, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendCanaryBody {
+				t.Errorf("Default canary should not be limited. Gotbody: %s", string(gotBody))
+			}
+		})
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		backendOrdersBody := "Hello, I'm Orders Canary!"
+		gotOrdersPaths := make(map[string]bool)
+		backendOrders, _ := setupServer(t, []byte(backendOrdersBody), http.StatusOK, func(r *http.Request) { gotOrdersPaths[r.URL.Path] = true })
+		defer backendOrders.Close()
+
+		sideCarToMain, sideCarToMainURL := setupServer(t, emptyBodyBytes, StatusCodeMain, func(r *http.Request) {})
+		defer sideCarToMain.Close()
+
+		sideCarToCanary, sideCarToCanaryURL := setupServer(t, emptyBodyBytes, StatusCodeCanary, func(r *http.Request) {})
+		defer sideCarToCanary.Close()
+
+		thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+			MainTarget:   backendMain.URL,
+			CanaryTarget: backendCanary.URL,
+			SidecarURL:   sideCarToMainURL.String(),
+			Routes: []config.Route{
+				{Name: "orders", PathPrefix: "/orders", Config: config.Config{
+					CanaryTarget: backendOrders.URL,
+					SidecarURL:   sideCarToCanaryURL.String(),
+					TrimPrefix:   "/orders",
+				}},
+				{Name: "api", Host: "api.localhost", Config: config.Config{
+					SidecarURL: sideCarToCanaryURL.String(),
+				}},
+				{Name: "payments", PathPrefix: "/payments", Config: config.Config{
+					Expression: "true",
+				}},
+			},
+		}))
+		defer thisRouter.Close()
+
+		testCases := []struct {
+			name     string
+			host     string
+			path     string
+			wantBody string
+		}{
+			{name: "path prefix route", path: "/orders/42", wantBody: backendOrdersBody},
+			{name: "path prefix route without trailing slash", path: "/orders", wantBody: backendOrdersBody},
+			{name: "host route", host: "api.localhost", path: "/foo/bar", wantBody: backendCanaryBody},
+			{name: "expression route under sidecar", path: "/payments/42", wantBody: backendCanaryBody},
+			{name: "no matching route", path: "/foo/bar", wantBody: backendMainBody},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				req, err := newRequest(http.MethodGet, thisRouter.URL+tc.path, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Host = tc.host
+
+				resp, err := thisRouter.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+
+				gotBody, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(gotBody) != tc.wantBody {
+					t.Errorf("Gotbody: %s Wantbody: %s", string(gotBody), tc.wantBody)
+				}
+			})
+		}
+
+		if !gotOrdersPaths["/42"] {
+			t.Errorf("Route trim-prefix not applied. Got paths: %v", gotOrdersPaths)
+		}
+
+		t.Run("affinity scoped to the route", func(t *testing.T) {
+			thisRouter := httptest.NewServer(setupThisRouterServerWithConfig(t, config.Config{
+				MainTarget:   backendMain.URL,
+				CanaryTarget: backendCanary.URL,
+				SidecarURL:   sideCarToMainURL.String(),
+				Sticky:       config.Sticky{SigningKey: "s3cr3t", CookieName: "affinity", TTL: 60},
+				Routes: []config.Route{
+					{Name: "a", PathPrefix: "/a", Config: config.Config{SidecarURL: sideCarToCanaryURL.String()}},
+					{Name: "b", PathPrefix: "/b", Config: config.Config{SidecarURL: sideCarToMainURL.String()}},
+				},
+			}))
+			defer thisRouter.Close()
+
+			restRequest := restRequest{httpHeader: http.Header{}, httpMethod: http.MethodGet, targetURL: thisRouter.URL + "/a/42"}
+			gotResp, gotBody := restClientCall(t, thisRouter.Client(), restRequest)
+			if string(gotBody) != backendCanaryBody {
+				t.Fatalf("Route a not forwarded to Canary. Gotbody: %s", string(gotBody))
+			}
+
+			gotCookies := gotResp.Cookies()
+			if len(gotCookies) != 1 || gotCookies[0].Path != "/a" {
+				t.Fatalf("Route a should pin with a cookie scoped to /a, got cookies %v", gotCookies)
+			}
+
+			pinnedRequest := restRequest
+			pinnedRequest.httpHeader = http.Header{"Cookie": {gotCookies[0].Name + "=" + gotCookies[0].Value}}
+			pinnedRequest.targetURL = thisRouter.URL + "/b/42"
+			_, gotBody = restClientCall(t, thisRouter.Client(), pinnedRequest)
+			if string(gotBody) != backendMainBody {
+				t.Errorf("Route b should not honor the cookie of route a. Gotbody: %s", string(gotBody))
+			}
+		})
 	})
 }
 
@@ -277,6 +1467,13 @@ func setupThisRouterServer(t *testing.T, backendMainURL, backendCanaryURL string
 			RequestLimitCanary: circuitBreakerParam.RequestLimitCanary,
 			ErrorLimitCanary:   circuitBreakerParam.ErrorLimitCanary,
 		}}
+
+	return setupThisRouterServerWithConfig(t, c)
+}
+
+func setupThisRouterServerWithConfig(t *testing.T, c config.Config) *Server {
+	t.Helper()
+
 	s, err := NewServer(c, "some-version")
 	if err != nil {
 		t.Fatal(errors.ErrorStack(err))
@@ -285,6 +1482,64 @@ func setupThisRouterServer(t *testing.T, backendMainURL, backendCanaryURL string
 	return s
 }
 
+// setupUpgradeServer creates a server switching the upgrade requests to a protocol echoing the lines it receives
+func setupUpgradeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isUpgradeRequest(req) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = rw.Flush()
+
+		line, _ := rw.ReadString('\n')
+		_, _ = rw.WriteString(line)
+		_ = rw.Flush()
+	}))
+}
+
+// upgradeCall sends an upgrade request to the server, then a line over the upgraded connection. It returns
+// the response status code, and the line echoed by the server.
+func upgradeCall(t *testing.T, serverURL string) (int, string) {
+	t.Helper()
+
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	fmt.Fprintf(conn, "GET /foo/bar HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", u.Host)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp.StatusCode, ""
+	}
+
+	fmt.Fprint(conn, "hello\n")
+	line, _ := reader.ReadString('\n')
+
+	return resp.StatusCode, line
+}
+
 // Create a mock canary server that give responses with 50:50 distribution for canaryrouter.StatusCodeMain and canaryrouter.StatusCodeCanary.
 // Make sure sidecar.OriginRequest.Body from rest client has only integer value.
 func setupSidecarServerFiftyFifty(t *testing.T) *httptest.Server {
@@ -470,3 +1725,157 @@ func Test_isErrorStatusCode(t *testing.T) {
 		})
 	}
 }
+
+func Test_NewServer_invalidConfig(t *testing.T) {
+	validConfig := func() config.Config {
+		return config.Config{MainTarget: "http://localhost:8081", CanaryTarget: "http://localhost:8082"}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *config.Config)
+	}{
+		{name: "bad main-target", modify: func(c *config.Config) { c.MainTarget = "localhost" }},
+		{name: "bad split canary-weight", modify: func(c *config.Config) { c.Split.CanaryWeight = config.Float64(120) }},
+		{name: "bad expression", modify: func(c *config.Config) { c.Expression = `method ==` }},
+		{name: "bad expression with sidecar", modify: func(c *config.Config) {
+			c.SidecarURL = "http://localhost:8084"
+			c.Expression = `method ==`
+		}},
+		{name: "bad rule target", modify: func(c *config.Config) { c.Rules = []config.Rule{{Target: "nowhere"}} }},
+		{name: "reserved target name", modify: func(c *config.Config) { c.Targets = map[string]config.Target{"Main": {URL: "http://localhost:8083"}} }},
+		{name: "route without host nor path-prefix", modify: func(c *config.Config) { c.Routes = []config.Route{{Name: "orders"}} }},
+		{name: "nested routes", modify: func(c *config.Config) {
+			c.Routes = []config.Route{{PathPrefix: "/orders", Config: config.Config{Routes: []config.Route{{PathPrefix: "/orders/items"}}}}}
+		}},
+		{name: "conflicting routes", modify: func(c *config.Config) {
+			c.Routes = []config.Route{{PathPrefix: "/orders"}, {PathPrefix: "/orders/"}}
+		}},
+		{name: "bad route config", modify: func(c *config.Config) {
+			c.Routes = []config.Route{{PathPrefix: "/orders", Config: config.Config{CanaryTarget: "orders.localhost"}}}
+		}},
+		{name: "bad target url", modify: func(c *config.Config) { c.Targets = map[string]config.Target{"beta": {URL: "beta.localhost"}} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.modify(&c)
+
+			if _, err := NewServer(c, "some-version"); err == nil {
+				t.Errorf("NewServer() expected error")
+			}
+		})
+	}
+}
+
+func Test_Server_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ramp := func(name string) config.Split {
+		return config.Split{Ramp: config.Ramp{
+			Steps:     []config.RampStep{{CanaryWeight: 1, Duration: 60}, {CanaryWeight: 100}},
+			StateFile: filepath.Join(dir, name+".json"),
+		}}
+	}
+
+	s, err := NewServer(config.Config{
+		MainTarget:   "http://localhost:8081",
+		CanaryTarget: "http://localhost:8082",
+		Split:        ramp("default"),
+		Routes:       []config.Route{{Name: "orders", PathPrefix: "/orders", Config: config.Config{Split: ramp("orders")}}},
+	}, "some-version")
+	if err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(errors.ErrorStack(err))
+	}
+
+	for _, name := range []string{"default", "orders"} {
+		if _, err := os.Stat(filepath.Join(dir, name+".json")); err != nil {
+			t.Errorf("Close() did not close the %s ramp: %v", name, err)
+		}
+	}
+}
+
+// errReader fails every read, like the body of a request whose client has gone away
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("client gone away")
+}
+
+func Test_Server_fallbackReleasesProbe(t *testing.T) {
+	s := setupThisRouterServerWithConfig(t, config.Config{
+		MainTarget:     "http://localhost:8081",
+		CanaryTarget:   "http://localhost:8082",
+		Split:          config.Split{CanaryWeight: config.Float64(100)},
+		Fallback:       config.Fallback{Enabled: config.Bool(true)},
+		CircuitBreaker: config.CircuitBreaker{ErrorLimitCanary: 1, CoolDown: 30},
+	})
+	defer s.Close()
+
+	breaker := s.defaultCanary().breaker
+	breaker.mu.Lock()
+	breaker.transition(breakerHalfOpen, time.Now())
+	breaker.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/foo/bar", errReader{}))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Got status code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if _, ok := breaker.takeProbe(httptest.NewRequest(http.MethodGet, "/", nil)); !ok {
+		t.Errorf("The probe of the request whose body could not be read has not been released")
+	}
+}
+
+func Test_NewServer_rampStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ramp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "ramp.json")
+	topLevelRamp := config.Ramp{Steps: []config.RampStep{{CanaryWeight: 1, Duration: 60}, {CanaryWeight: 100}}, StateFile: stateFile}
+
+	tests := []struct {
+		name    string
+		route   config.Config
+		wantErr bool
+	}{
+		{name: "inherited ramp", route: config.Config{}, wantErr: false},
+		{name: "own ramp", route: config.Config{Split: config.Split{Ramp: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 100}}}}}, wantErr: false},
+		{
+			name:    "own ramp sharing the state file",
+			route:   config.Config{Split: config.Split{Ramp: config.Ramp{Steps: []config.RampStep{{CanaryWeight: 100}}, StateFile: filepath.Join(dir, ".", "ramp.json")}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServer(config.Config{
+				MainTarget:   "http://localhost:8081",
+				CanaryTarget: "http://localhost:8082",
+				Split:        config.Split{Ramp: topLevelRamp},
+				Routes:       []config.Route{{Name: "orders", PathPrefix: "/orders", Config: tt.route}},
+			}, "some-version")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if s != nil {
+				if err := s.Close(); err != nil {
+					t.Fatal(errors.ErrorStack(err))
+				}
+			}
+		})
+	}
+}
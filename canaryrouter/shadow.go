@@ -0,0 +1,284 @@
+package canaryrouter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
+)
+
+const (
+	defaultShadowWorkers   = 10
+	defaultShadowQueueSize = 100
+
+	shadowStatusError   = "error"
+	shadowStatusDropped = "dropped"
+)
+
+// shadow mirrors requests served by main to a canary target. The mirrored requests are sent by a
+// fixed number of workers from a bounded queue, so that mirroring never slows main down: when the
+// queue is full, the mirrored request is dropped.
+type shadow struct {
+	route      string
+	target     *canaryTarget
+	sampleRate uint64
+	queue      chan *shadowJob
+	differ     *shadowDiffer
+	metricCtx  context.Context
+	workers    sync.WaitGroup
+
+	// mu guards closed, so that no job is queued once the queue is closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// shadowJob is a mirrored request, along with main response when the responses are compared
+type shadowJob struct {
+	req  *http.Request
+	main *capturedResponse
+}
+
+func newShadow(shadowConfig config.Shadow, targets map[string]*canaryTarget, route string, metricCtx context.Context) (*shadow, error) {
+	sampleRate, err := toBasisPoints(valueOf(shadowConfig.SampleRate))
+	if err != nil {
+		return nil, errors.Annotate(err, "shadow sample-rate")
+	}
+
+	targetName := strings.ToLower(shadowConfig.Target)
+	if targetName == "" {
+		targetName = TargetCanary
+	}
+
+	target, ok := targets[targetName]
+	if !ok {
+		return nil, errors.Errorf("shadow target %q is not recognized", shadowConfig.Target)
+	}
+
+	workers := shadowConfig.Workers
+	if workers == 0 {
+		workers = defaultShadowWorkers
+	}
+
+	queueSize := shadowConfig.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultShadowQueueSize
+	}
+
+	if workers < 0 || queueSize < 0 {
+		return nil, errors.Errorf("shadow workers and queue-size must be positive, got %d and %d", workers, queueSize)
+	}
+
+	metricCtx, err = instrumentation.AddTargetTag(metricCtx, target.name)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	sh := &shadow{
+		route:      route,
+		target:     target,
+		sampleRate: sampleRate,
+		queue:      make(chan *shadowJob, queueSize),
+		metricCtx:  metricCtx,
+	}
+
+	if isTrue(shadowConfig.Diff.Enabled) {
+		sh.differ, err = newShadowDiffer(shadowConfig.Diff)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	sh.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go sh.work()
+	}
+
+	return sh, nil
+}
+
+// serve serves the request with main, and queues a copy of it to be sent to the shadow target
+// if it is sampled. Upgrade requests are never mirrored, as their connection is hijacked.
+func (sh *shadow) serve(w http.ResponseWriter, req *http.Request, main http.Handler) {
+	if isUpgradeRequest(req) || uint64(rand.Intn(splitScale)) >= sh.sampleRate {
+		main.ServeHTTP(w, req)
+		return
+	}
+
+	outreq, err := cloneRequest(req)
+	if err != nil {
+		log.Printf("Failed to mirror request: %v", err)
+		main.ServeHTTP(w, req)
+		return
+	}
+
+	if sh.differ == nil {
+		sh.enqueue(&shadowJob{req: outreq})
+		main.ServeHTTP(w, req)
+		return
+	}
+
+	// NOTE: The request is mirrored once main has responded, so that both responses can be compared
+	capture := newResponseCapture(w, sh.differ.maxBodySize)
+	main.ServeHTTP(capture, req)
+
+	mainResponse := capture.captured()
+	sh.enqueue(&shadowJob{req: outreq, main: &mainResponse})
+}
+
+func (sh *shadow) enqueue(job *shadowJob) {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	if sh.closed {
+		sh.record(shadowStatusDropped, 0)
+		return
+	}
+
+	select {
+	case sh.queue <- job:
+	default:
+		sh.record(shadowStatusDropped, 0)
+	}
+}
+
+func (sh *shadow) work() {
+	defer sh.workers.Done()
+
+	for job := range sh.queue {
+		sh.send(job)
+	}
+}
+
+// send forwards the mirrored request to the shadow target, and compares its response to main response
+// if it is provided. The response is discarded otherwise.
+func (sh *shadow) send(job *shadowJob) {
+	outreq := job.req
+	method, path := outreq.Method, outreq.URL.Path
+	sh.target.proxy.Director(outreq)
+
+	start := time.Now()
+	resp, err := sh.target.proxy.Transport.RoundTrip(outreq)
+	if err != nil {
+		log.WithField("proxy", "shadow").Infof("http: shadow error: %v", err)
+		sh.record(shadowStatusError, time.Since(start))
+		return
+	}
+	defer resp.Body.Close()
+
+	if job.main == nil {
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			log.WithField("proxy", "shadow").Infof("http: shadow error: %v", err)
+			sh.record(shadowStatusError, time.Since(start))
+			return
+		}
+
+		sh.record(strconv.Itoa(resp.StatusCode), time.Since(start))
+		return
+	}
+
+	canaryResponse, err := readCapturedResponse(resp, sh.differ.maxBodySize)
+	if err != nil {
+		log.WithField("proxy", "shadow").Infof("http: shadow error: %v", err)
+		sh.record(shadowStatusError, time.Since(start))
+		return
+	}
+
+	sh.record(strconv.Itoa(resp.StatusCode), time.Since(start))
+
+	diff := sh.differ.compare(*job.main, canaryResponse)
+	diff.Time = time.Now()
+	diff.Route = sh.route
+	diff.Target = sh.target.name
+	diff.Method = method
+	diff.Path = path
+
+	ctx, err := instrumentation.AddMismatchTag(sh.metricCtx, diff.Mismatch)
+	if err != nil {
+		log.Errorln(err)
+	}
+	instrumentation.RecordShadowDiff(ctx)
+
+	if diff.Mismatch != mismatchNone {
+		sh.differ.logSample(diff)
+	}
+}
+
+// close stops the workers once they have sent the queued requests, then releases the resources of the
+// shadow, the mismatch log file if it is set. The requests mirrored afterwards are dropped.
+func (sh *shadow) close() error {
+	sh.mu.Lock()
+	if sh.closed {
+		sh.mu.Unlock()
+		return nil
+	}
+	sh.closed = true
+	close(sh.queue)
+	sh.mu.Unlock()
+
+	sh.workers.Wait()
+
+	if sh.differ == nil {
+		return nil
+	}
+
+	return sh.differ.close()
+}
+
+func (sh *shadow) record(status string, latency time.Duration) {
+	ctx, err := instrumentation.AddStatusTag(sh.metricCtx, status)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	if status == shadowStatusDropped {
+		instrumentation.RecordShadowDropped(ctx)
+		return
+	}
+
+	instrumentation.RecordShadowLatency(ctx, latency)
+}
+
+// cloneRequest returns a copy of the request detached from its context, so that it outlives the
+// original request. The body is duplicated, the original req.Body can still be used throughout the request.
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	outreq := req.WithContext(context.Background())
+
+	outURL := *req.URL
+	outreq.URL = &outURL
+
+	outreq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		outreq.Header[name] = append([]string(nil), values...)
+	}
+
+	outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	outreq.ContentLength = int64(len(body))
+	outreq.RequestURI = ""
+
+	return outreq, nil
+}
+
+func (s *Server) isShadowEnabled() bool {
+	return s.shadow != nil
+}
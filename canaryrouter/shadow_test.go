@@ -0,0 +1,130 @@
+package canaryrouter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newShadow(t *testing.T) {
+	targets, err := newCanaryTargets(config.Config{
+		CanaryTarget: "http://canary.localhost",
+		Targets:      map[string]config.Target{"beta": {URL: "http://beta.localhost"}},
+	}, nil, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    config.Shadow
+		wantErr bool
+	}{
+		{name: "default target", args: config.Shadow{SampleRate: config.Float64(100)}, wantErr: false},
+		{name: "named target", args: config.Shadow{SampleRate: config.Float64(10), Target: "Beta"}, wantErr: false},
+		{name: "unknown target", args: config.Shadow{SampleRate: config.Float64(10), Target: "gamma"}, wantErr: true},
+		{name: "bad sample rate", args: config.Shadow{SampleRate: config.Float64(200)}, wantErr: true},
+		{name: "negative workers", args: config.Shadow{SampleRate: config.Float64(10), Workers: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newShadow(tt.args, targets, DefaultRouteName, context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newShadow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_cloneRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/foo/bar?baz=1", strings.NewReader("foo bar body"))
+	req.Header.Set("X-Foo", "bar")
+
+	outreq, err := cloneRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outreq.URL.Path = "/changed"
+	outreq.Header.Set("X-Foo", "changed")
+
+	if req.URL.Path != "/foo/bar" || req.Header.Get("X-Foo") != "bar" {
+		t.Errorf("cloneRequest() shares URL or headers with the original request")
+	}
+
+	for name, r := range map[string]*http.Request{"original": req, "clone": outreq} {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != "foo bar body" {
+			t.Errorf("cloneRequest() %s body = %q, want %q", name, string(body), "foo bar body")
+		}
+	}
+}
+
+func Test_shadow_close(t *testing.T) {
+	backendCanary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backendCanary.Close()
+
+	dir, err := ioutil.TempDir("", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	targets, err := newCanaryTargets(config.Config{CanaryTarget: backendCanary.URL}, nil, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logFile := filepath.Join(dir, "shadow-diff.log")
+	sh, err := newShadow(config.Shadow{
+		SampleRate: config.Float64(100),
+		Workers:    2,
+		Diff:       config.ShadowDiff{Enabled: config.Bool(true), LogFile: logFile},
+	}, targets, DefaultRouteName, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newJob := func() *shadowJob {
+		outreq, err := cloneRequest(httptest.NewRequest(http.MethodGet, "/foo/bar", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &shadowJob{req: outreq, main: &capturedResponse{statusCode: http.StatusOK, header: http.Header{}}}
+	}
+
+	jobs := 5
+	for i := 0; i < jobs; i++ {
+		sh.enqueue(newJob())
+	}
+
+	if err := sh.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: A request mirrored once the shadow is closed is dropped, rather than queued
+	sh.enqueue(newJob())
+
+	content, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Count(string(content), "\n"); got != jobs {
+		t.Errorf("close() did not wait for the queued requests, got %d mismatch samples, want %d", got, jobs)
+	}
+}
@@ -0,0 +1,501 @@
+package canaryrouter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/ratelimit"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+const (
+	defaultShadowDiffMaxBodySize  = 1 << 20
+	defaultShadowDiffLogPerMinute = 10
+
+	// maxDiffBodyPaths is the maximum number of differing JSON body paths reported by a mismatch sample
+	maxDiffBodyPaths = 20
+
+	mismatchNone   = "none"
+	mismatchStatus = "status"
+	mismatchHeader = "header"
+	mismatchBody   = "body"
+
+	// bodyRootPath is the path reported when the bodies differ as a whole, e.g. when they are not JSON
+	bodyRootPath = "."
+)
+
+// capturedResponse holds a response to be compared, its body is only kept up to the max body size
+type capturedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	truncated  bool
+}
+
+// responseCapture writes the response to the client while capturing it
+type responseCapture struct {
+	http.ResponseWriter
+
+	maxBodySize int
+	response    capturedResponse
+	wroteHeader bool
+}
+
+func newResponseCapture(w http.ResponseWriter, maxBodySize int) *responseCapture {
+	return &responseCapture{ResponseWriter: w, maxBodySize: maxBodySize}
+}
+
+func (c *responseCapture) WriteHeader(statusCode int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.response.statusCode = statusCode
+		c.response.header = cloneHeader(c.ResponseWriter.Header())
+	}
+
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.response.truncated {
+		if len(c.response.body)+len(b) > c.maxBodySize {
+			c.response.truncated = true
+			c.response.body = nil
+		} else {
+			c.response.body = append(c.response.body, b...)
+		}
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, so that streamed main responses are still flushed to the client while
+// they are captured
+func (c *responseCapture) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// captured returns the captured response, a handler which has written nothing responds 200
+func (c *responseCapture) captured() capturedResponse {
+	if !c.wroteHeader {
+		return capturedResponse{statusCode: http.StatusOK, header: cloneHeader(c.ResponseWriter.Header())}
+	}
+
+	return c.response
+}
+
+// readCapturedResponse reads the response body up to maxBodySize, the rest of the body is discarded
+func readCapturedResponse(resp *http.Response, maxBodySize int) (capturedResponse, error) {
+	captured := capturedResponse{statusCode: resp.StatusCode, header: resp.Header}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxBodySize)+1))
+	if err != nil {
+		return captured, errors.Trace(err)
+	}
+
+	if len(body) > maxBodySize {
+		captured.truncated = true
+	} else {
+		captured.body = body
+	}
+
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+
+	return captured, errors.Trace(err)
+}
+
+func cloneHeader(header http.Header) http.Header {
+	cloned := make(http.Header, len(header))
+	for name, values := range header {
+		cloned[name] = append([]string(nil), values...)
+	}
+
+	return cloned
+}
+
+// responseDiff is a mismatch sample between main response and the mirrored canary response
+type responseDiff struct {
+	Time         time.Time            `json:"time"`
+	Route        string               `json:"route"`
+	Target       string               `json:"target"`
+	Method       string               `json:"method"`
+	Path         string               `json:"path"`
+	Mismatch     string               `json:"mismatch"`
+	MainStatus   int                  `json:"main-status"`
+	CanaryStatus int                  `json:"canary-status"`
+	Headers      map[string][2]string `json:"headers,omitempty"`
+	BodyPaths    []string             `json:"body-paths,omitempty"`
+}
+
+// shadowDiffer compares the mirrored canary responses to main responses
+type shadowDiffer struct {
+	headers       []string
+	ignoredFields [][]string
+	maxBodySize   int
+
+	logBucket *ratelimit.Bucket
+	logFile   io.WriteCloser
+	closeOnce sync.Once
+}
+
+func newShadowDiffer(diffConfig config.ShadowDiff) (*shadowDiffer, error) {
+	d := &shadowDiffer{
+		headers:     diffConfig.Headers,
+		maxBodySize: diffConfig.MaxBodySize,
+	}
+
+	for _, field := range diffConfig.IgnoredFields {
+		if field == "" {
+			return nil, errors.New("shadow diff ignored-fields must not be empty")
+		}
+		d.ignoredFields = append(d.ignoredFields, strings.Split(field, "."))
+	}
+
+	if d.maxBodySize == 0 {
+		d.maxBodySize = defaultShadowDiffMaxBodySize
+	}
+	if d.maxBodySize < 0 {
+		return nil, errors.Errorf("shadow diff max-body-size must be positive, got %d", diffConfig.MaxBodySize)
+	}
+
+	logPerMinute := diffConfig.LogPerMinute
+	if logPerMinute == 0 {
+		logPerMinute = defaultShadowDiffLogPerMinute
+	}
+	if logPerMinute < 0 {
+		return nil, errors.Errorf("shadow diff log-per-minute must be positive, got %d", diffConfig.LogPerMinute)
+	}
+	d.logBucket = ratelimit.NewBucketWithQuantum(time.Minute, int64(logPerMinute), int64(logPerMinute))
+
+	if diffConfig.LogFile != "" {
+		logFile, err := openSharedLogFile(diffConfig.LogFile)
+		if err != nil {
+			return nil, errors.Annotate(err, "shadow diff log-file")
+		}
+		d.logFile = logFile
+	}
+
+	return d, nil
+}
+
+// close closes the mismatch log file, if it is set
+func (d *shadowDiffer) close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		if d.logFile != nil {
+			err = d.logFile.Close()
+		}
+	})
+
+	return errors.Trace(err)
+}
+
+// sharedLogFiles are the opened mismatch log files by path, so that the routes writing to the same path
+// share a single file
+var sharedLogFiles = struct {
+	sync.Mutex
+	files map[string]*sharedLogFile
+}{files: make(map[string]*sharedLogFile)}
+
+// sharedLogFile is a mismatch log file shared by the differs writing to its path, so that their lines do
+// not interleave. It is closed along with the last of them.
+type sharedLogFile struct {
+	path string
+	refs int
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openSharedLogFile(path string) (*sharedLogFile, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sharedLogFiles.Lock()
+	defer sharedLogFiles.Unlock()
+
+	if f, ok := sharedLogFiles.files[absPath]; ok {
+		f.refs++
+		return f, nil
+	}
+
+	file, err := os.OpenFile(absPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	f := &sharedLogFile{path: absPath, refs: 1, file: file}
+	sharedLogFiles.files[absPath] = f
+
+	return f, nil
+}
+
+func (f *sharedLogFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Write(b)
+}
+
+// Close closes the file once none of the differs writes to it anymore
+func (f *sharedLogFile) Close() error {
+	sharedLogFiles.Lock()
+	defer sharedLogFiles.Unlock()
+
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+
+	delete(sharedLogFiles.files, f.path)
+
+	return f.file.Close()
+}
+
+// compare returns the differences between main and canary responses, its Mismatch is the first
+// difference found, or "none" if the responses match
+func (d *shadowDiffer) compare(main, canary capturedResponse) responseDiff {
+	diff := responseDiff{
+		Mismatch:     mismatchNone,
+		MainStatus:   main.statusCode,
+		CanaryStatus: canary.statusCode,
+	}
+
+	for _, name := range d.headers {
+		mainValue, canaryValue := main.header.Get(name), canary.header.Get(name)
+		if mainValue != canaryValue {
+			if diff.Headers == nil {
+				diff.Headers = make(map[string][2]string)
+			}
+			diff.Headers[http.CanonicalHeaderKey(name)] = [2]string{mainValue, canaryValue}
+		}
+	}
+
+	diff.BodyPaths = d.compareBody(main, canary)
+
+	switch {
+	case main.statusCode != canary.statusCode:
+		diff.Mismatch = mismatchStatus
+	case len(diff.Headers) > 0:
+		diff.Mismatch = mismatchHeader
+	case len(diff.BodyPaths) > 0:
+		diff.Mismatch = mismatchBody
+	}
+
+	return diff
+}
+
+// compareBody returns the paths of the JSON body fields which differ. Bodies larger than the max body size
+// are not compared.
+func (d *shadowDiffer) compareBody(main, canary capturedResponse) []string {
+	if main.truncated || canary.truncated {
+		return nil
+	}
+
+	mainBody, mainErr := decodeBody(main)
+	canaryBody, canaryErr := decodeBody(canary)
+	if mainErr != nil || canaryErr != nil {
+		return nil
+	}
+
+	var mainJSON, canaryJSON interface{}
+	if json.Unmarshal(mainBody, &mainJSON) != nil || json.Unmarshal(canaryBody, &canaryJSON) != nil {
+		if !bytes.Equal(mainBody, canaryBody) {
+			return []string{bodyRootPath}
+		}
+		return nil
+	}
+
+	for _, field := range d.ignoredFields {
+		mainJSON = removeJSONField(mainJSON, field)
+		canaryJSON = removeJSONField(canaryJSON, field)
+	}
+
+	var paths []string
+	diffJSON("", mainJSON, canaryJSON, &paths)
+
+	return paths
+}
+
+// decodeBody returns the body uncompressed, if it is gzip encoded
+func decodeBody(response capturedResponse) ([]byte, error) {
+	if response.header.Get("Content-Encoding") != "gzip" {
+		return response.body, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(response.body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// removeJSONField removes the field at path from the decoded JSON value. Array elements are replaced
+// by null rather than removed, so that the other elements keep their index.
+func removeJSONField(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	segment, rest := path[0], path[1:]
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if segment != "*" && segment != key {
+				continue
+			}
+
+			if len(rest) == 0 {
+				delete(typed, key)
+			} else {
+				typed[key] = removeJSONField(child, rest)
+			}
+		}
+	case []interface{}:
+		for i, child := range typed {
+			if segment != "*" && segment != strconv.Itoa(i) {
+				continue
+			}
+
+			if len(rest) == 0 {
+				typed[i] = nil
+			} else {
+				typed[i] = removeJSONField(child, rest)
+			}
+		}
+	}
+
+	return value
+}
+
+// diffJSON appends to paths the paths of the fields which differ between the decoded JSON values a and b
+func diffJSON(path string, a, b interface{}, paths *[]string) {
+	if len(*paths) >= maxDiffBodyPaths {
+		return
+	}
+
+	switch typedA := a.(type) {
+	case map[string]interface{}:
+		typedB, ok := b.(map[string]interface{})
+		if !ok {
+			appendDiffPath(paths, path)
+			return
+		}
+
+		keys := make(map[string]struct{}, len(typedA)+len(typedB))
+		for key := range typedA {
+			keys[key] = struct{}{}
+		}
+		for key := range typedB {
+			keys[key] = struct{}{}
+		}
+
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			sortedKeys = append(sortedKeys, key)
+		}
+		sort.Strings(sortedKeys)
+
+		for _, key := range sortedKeys {
+			childA, okA := typedA[key]
+			childB, okB := typedB[key]
+			childPath := joinJSONPath(path, key)
+
+			if okA != okB {
+				appendDiffPath(paths, childPath)
+				continue
+			}
+
+			diffJSON(childPath, childA, childB, paths)
+		}
+	case []interface{}:
+		typedB, ok := b.([]interface{})
+		if !ok || len(typedA) != len(typedB) {
+			appendDiffPath(paths, path)
+			return
+		}
+
+		for i := range typedA {
+			diffJSON(joinJSONPath(path, strconv.Itoa(i)), typedA[i], typedB[i], paths)
+		}
+	default:
+		if !reflect.DeepEqual(a, b) {
+			appendDiffPath(paths, path)
+		}
+	}
+}
+
+func appendDiffPath(paths *[]string, path string) {
+	if len(*paths) >= maxDiffBodyPaths {
+		return
+	}
+
+	if path == "" {
+		path = bodyRootPath
+	}
+
+	*paths = append(*paths, path)
+}
+
+func joinJSONPath(path, segment string) string {
+	if path == "" {
+		return segment
+	}
+
+	return path + "." + segment
+}
+
+// logSample writes the mismatch sample, unless too many have already been written in the last minute
+func (d *shadowDiffer) logSample(diff responseDiff) {
+	if d.logBucket.TakeAvailable(1) == 0 {
+		return
+	}
+
+	if d.logFile == nil {
+		log.WithFields(log.Fields{
+			"route":         diff.Route,
+			"target":        diff.Target,
+			"method":        diff.Method,
+			"path":          diff.Path,
+			"mismatch":      diff.Mismatch,
+			"main-status":   diff.MainStatus,
+			"canary-status": diff.CanaryStatus,
+			"headers":       diff.Headers,
+			"body-paths":    diff.BodyPaths,
+		}).Info("Shadow response mismatch")
+		return
+	}
+
+	line, err := json.Marshal(diff)
+	if err != nil {
+		log.Errorf("Failed to marshal shadow response mismatch: %v", err)
+		return
+	}
+
+	if _, err := d.logFile.Write(append(line, '\n')); err != nil {
+		log.Errorf("Failed to write shadow response mismatch: %v", err)
+	}
+}
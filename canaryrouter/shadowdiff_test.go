@@ -0,0 +1,201 @@
+package canaryrouter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_shadowDiffer_compare(t *testing.T) {
+	jsonResponse := func(statusCode int, body string) capturedResponse {
+		return capturedResponse{statusCode: statusCode, header: http.Header{"Content-Type": {"application/json"}}, body: []byte(body)}
+	}
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzipWriter.Write([]byte(`{"id":2,"name":"foo"}`))
+	_ = gzipWriter.Close()
+
+	tests := []struct {
+		name          string
+		main          capturedResponse
+		canary        capturedResponse
+		wantMismatch  string
+		wantHeaders   map[string][2]string
+		wantBodyPaths []string
+	}{
+		{
+			name:         "match",
+			main:         jsonResponse(200, `{"id":1,"name":"foo"}`),
+			canary:       jsonResponse(200, `{"name":"foo","id":1}`),
+			wantMismatch: mismatchNone,
+		},
+		{
+			name:          "status",
+			main:          jsonResponse(200, `{"id":1}`),
+			canary:        jsonResponse(500, `{"error":"boom"}`),
+			wantMismatch:  mismatchStatus,
+			wantBodyPaths: []string{"error", "id"},
+		},
+		{
+			name:         "header",
+			main:         capturedResponse{statusCode: 200, header: http.Header{"Content-Type": {"application/json"}}},
+			canary:       capturedResponse{statusCode: 200, header: http.Header{"Content-Type": {"text/plain"}}},
+			wantMismatch: mismatchHeader,
+			wantHeaders:  map[string][2]string{"Content-Type": {"application/json", "text/plain"}},
+		},
+		{
+			name:          "body field",
+			main:          jsonResponse(200, `{"data":{"items":[{"id":1,"price":10},{"id":2,"price":20}]}}`),
+			canary:        jsonResponse(200, `{"data":{"items":[{"id":1,"price":10},{"id":2,"price":25}]}}`),
+			wantMismatch:  mismatchBody,
+			wantBodyPaths: []string{"data.items.1.price"},
+		},
+		{
+			name:         "ignored fields",
+			main:         jsonResponse(200, `{"requestId":"a","data":{"items":[{"id":1,"updatedAt":"2019-01-01"}]}}`),
+			canary:       jsonResponse(200, `{"requestId":"b","data":{"items":[{"id":1,"updatedAt":"2019-01-02"}]}}`),
+			wantMismatch: mismatchNone,
+		},
+		{
+			name:          "array length",
+			main:          jsonResponse(200, `{"data":{"items":[1,2]}}`),
+			canary:        jsonResponse(200, `{"data":{"items":[1]}}`),
+			wantMismatch:  mismatchBody,
+			wantBodyPaths: []string{"data.items"},
+		},
+		{
+			name:          "not JSON",
+			main:          capturedResponse{statusCode: 200, header: http.Header{}, body: []byte("foo")},
+			canary:        capturedResponse{statusCode: 200, header: http.Header{}, body: []byte("bar")},
+			wantMismatch:  mismatchBody,
+			wantBodyPaths: []string{bodyRootPath},
+		},
+		{
+			name:         "truncated body is not compared",
+			main:         capturedResponse{statusCode: 200, header: http.Header{}, truncated: true},
+			canary:       capturedResponse{statusCode: 200, header: http.Header{}, body: []byte("bar")},
+			wantMismatch: mismatchNone,
+		},
+		{
+			name:          "gzip encoded",
+			main:          jsonResponse(200, `{"id":1,"name":"foo"}`),
+			canary:        capturedResponse{statusCode: 200, header: http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}, body: gzipped.Bytes()},
+			wantMismatch:  mismatchBody,
+			wantBodyPaths: []string{"id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newShadowDiffer(config.ShadowDiff{
+				Enabled:       config.Bool(true),
+				Headers:       []string{"content-type"},
+				IgnoredFields: []string{"requestId", "data.items.*.updatedAt"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := d.compare(tt.main, tt.canary)
+			if got.Mismatch != tt.wantMismatch {
+				t.Errorf("shadowDiffer.compare() mismatch = %q, want %q", got.Mismatch, tt.wantMismatch)
+			}
+
+			if !reflect.DeepEqual(got.Headers, tt.wantHeaders) {
+				t.Errorf("shadowDiffer.compare() headers = %v, want %v", got.Headers, tt.wantHeaders)
+			}
+
+			if !reflect.DeepEqual(got.BodyPaths, tt.wantBodyPaths) {
+				t.Errorf("shadowDiffer.compare() body paths = %v, want %v", got.BodyPaths, tt.wantBodyPaths)
+			}
+		})
+	}
+}
+
+func Test_responseCapture(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxBodySize   int
+		writes        []string
+		wantBody      string
+		wantTruncated bool
+	}{
+		{name: "within max body size", maxBodySize: 10, writes: []string{"foo", "bar"}, wantBody: "foobar"},
+		{name: "above max body size", maxBodySize: 5, writes: []string{"foo", "bar"}, wantTruncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			capture := newResponseCapture(recorder, tt.maxBodySize)
+
+			capture.Header().Set("X-Foo", "bar")
+			capture.WriteHeader(http.StatusCreated)
+			for _, write := range tt.writes {
+				if _, err := capture.Write([]byte(write)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := capture.captured()
+			if got.statusCode != http.StatusCreated || got.header.Get("X-Foo") != "bar" {
+				t.Errorf("responseCapture.captured() = %d %v, want %d with X-Foo header", got.statusCode, got.header, http.StatusCreated)
+			}
+
+			if string(got.body) != tt.wantBody || got.truncated != tt.wantTruncated {
+				t.Errorf("responseCapture.captured() body = %q truncated = %v, want %q %v", string(got.body), got.truncated, tt.wantBody, tt.wantTruncated)
+			}
+
+			if recorder.Body.String() != "foobar" {
+				t.Errorf("responseCapture did not forward the body, got %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func Test_openSharedLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "diff.log")
+	f1, err := openSharedLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := openSharedLogFile(filepath.Join(dir, ".", "diff.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f1 != f2 {
+		t.Fatalf("openSharedLogFile() of the same path opened it twice")
+	}
+
+	if err := f1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.Write([]byte("line\n")); err != nil {
+		t.Errorf("Write() once another differ is closed error = %v", err)
+	}
+
+	if err := f2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f2.Write([]byte("line\n")); err == nil {
+		t.Errorf("Write() once all the differs are closed expected error")
+	}
+
+	if got, _ := ioutil.ReadFile(path); string(got) != "line\n" {
+		t.Errorf("log file = %q, want %q", string(got), "line\n")
+	}
+}
@@ -0,0 +1,222 @@
+package canaryrouter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/sidecarpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// schemeGRPC is the sidecar-url scheme of a gRPC sidecar
+	schemeGRPC = "grpc"
+
+	// schemeGRPCS is the sidecar-url scheme of a gRPC sidecar over TLS
+	schemeGRPCS = "grpcs"
+)
+
+// sidecarCloser is implemented by the sidecars holding connections, e.g. the gRPC sidecars
+type sidecarCloser interface {
+	close() error
+}
+
+// closeSidecar closes the connections of the sidecar built by newSidecar, if it holds any
+func closeSidecar(sidecar Decider) error {
+	if closer, ok := sidecar.(sidecarCloser); ok {
+		return closer.close()
+	}
+
+	return nil
+}
+
+func newSidecar(cfg config.Config) (Decider, error) {
+	body, err := newSidecarBody(cfg.SidecarBody)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(cfg.SidecarURLs) > 0 {
+		if cfg.SidecarURL != "" {
+			return nil, errors.New("sidecar-url and sidecar-urls are mutually exclusive")
+		}
+
+		pool, err := newSidecarPool(cfg, body)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return pool, nil
+	}
+
+	return newSidecarInstance(cfg.SidecarURL, cfg, body)
+}
+
+// newSidecarInstance returns the sidecar of sidecarURL, a gRPC sidecar if its scheme is grpc:// (or grpcs://
+// over TLS) or an HTTP sidecar otherwise
+func newSidecarInstance(sidecarURL string, cfg config.Config, body *sidecarBody) (Decider, error) {
+	parsedURL, err := url.ParseRequestURI(sidecarURL)
+	if err != nil {
+		return nil, errors.Annotatef(err, "sidecar url %s", sidecarURL)
+	}
+
+	if scheme := strings.ToLower(parsedURL.Scheme); scheme == schemeGRPC || scheme == schemeGRPCS {
+		sidecar, err := newGRPCSidecar(parsedURL.Host, scheme == schemeGRPCS, cfg.Client.Sidecar, body)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return sidecar, nil
+	}
+
+	sidecar, err := newHTTPSidecar(sidecarURL, cfg, body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return sidecar, nil
+}
+
+// httpSidecar forwards the request to the sidecar, and decodes the decision from its response
+type httpSidecar struct {
+	proxy   *httputil.ReverseProxy
+	decoder decoder
+	body    *sidecarBody
+}
+
+func newHTTPSidecar(sidecarURL string, cfg config.Config, body *sidecarBody) (*httpSidecar, error) {
+	proxy, err := newReverseProxy(sidecarURL, "", cfg.Log.DebugResponseBody)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	proxy.Transport = newTransport(cfg.Client.Sidecar)
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		w.(*sidecarRecorder).err = err
+		w.WriteHeader(StatusSidecarError)
+	}
+
+	decoder, err := newDecoder(cfg.SidecarProtocol)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &httpSidecar{proxy: proxy, decoder: decoder, body: body}, nil
+}
+
+func (h *httpSidecar) Decide(req *http.Request) (*Decision, error) {
+	body, err := h.body.read(req)
+	if err != nil {
+		return nil, err
+	}
+
+	outreq := req.WithContext(req.Context())
+	outreq.Body = http.NoBody
+	outreq.ContentLength = 0
+	outreq.TransferEncoding = nil
+	if len(body) > 0 {
+		outreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		outreq.ContentLength = int64(len(body))
+	}
+
+	recorder := &sidecarRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.proxy.ServeHTTP(recorder, outreq)
+
+	if recorder.err != nil {
+		return nil, recorder.err
+	}
+
+	return h.decoder(recorder.Code, recorder.Header(), recorder.Body.Bytes())
+}
+
+// sidecarRecorder records the sidecar response, or the error of the sidecar call
+type sidecarRecorder struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+// grpcSidecar calls the Decide method of a gRPC sidecar, over a persistent connection
+type grpcSidecar struct {
+	conn    *grpc.ClientConn
+	client  sidecarpb.SidecarClient
+	timeout time.Duration
+	body    *sidecarBody
+}
+
+// newGRPCSidecar connects to the gRPC sidecar, over TLS if useTLS is set or if the client TLS settings are set
+func newGRPCSidecar(target string, useTLS bool, clientConfig config.HTTPClientConfig, body *sidecarBody) (*grpcSidecar, error) {
+	transportOption := grpc.WithInsecure()
+	if useTLS || clientConfig.TLS != (config.TLS{}) {
+		transportOption = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: clientConfig.TLS.InsecureSkipVerify}))
+	}
+
+	// NOTE: Dialing does not block, the connection is established (and re-established) in the background
+	conn, err := grpc.Dial(target, transportOption)
+	if err != nil {
+		return nil, errors.Annotatef(err, "sidecar-url %s", target)
+	}
+
+	return &grpcSidecar{
+		conn:    conn,
+		client:  sidecarpb.NewSidecarClient(conn),
+		timeout: time.Duration(clientConfig.Timeout) * time.Second,
+		body:    body,
+	}, nil
+}
+
+func (g *grpcSidecar) close() error {
+	return errors.Trace(g.conn.Close())
+}
+
+func (g *grpcSidecar) Decide(req *http.Request) (*Decision, error) {
+	body, err := g.body.read(req)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &sidecarpb.DecideRequest{
+		Method:   req.Method,
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		RawQuery: req.URL.RawQuery,
+		Headers:  make([]*sidecarpb.Header, 0, len(req.Header)),
+		Body:     body,
+	}
+	for name, values := range req.Header {
+		in.Headers = append(in.Headers, &sidecarpb.Header{Name: name, Values: values})
+	}
+
+	ctx := req.Context()
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	out, err := g.client.Decide(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := SidecarResponse{
+		Target:        out.Target,
+		Reason:        out.Reason,
+		SetHeaders:    out.SetHeaders,
+		RemoveHeaders: out.RemoveHeaders,
+		RewritePath:   out.RewritePath,
+	}
+	if out.CacheTtl != 0 {
+		cacheTTL := int(out.CacheTtl)
+		resp.CacheTTL = &cacheTTL
+	}
+
+	return resp.decision(0)
+}
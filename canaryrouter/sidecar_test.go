@@ -0,0 +1,192 @@
+package canaryrouter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/sidecarpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// decideFunc implements the gRPC sidecar with a function
+type decideFunc func(ctx context.Context, in *sidecarpb.DecideRequest) (*sidecarpb.DecideResponse, error)
+
+func (f decideFunc) Decide(ctx context.Context, in *sidecarpb.DecideRequest) (*sidecarpb.DecideResponse, error) {
+	return f(ctx, in)
+}
+
+// setupGRPCSidecar starts a gRPC sidecar and returns its grpc:// URL
+func setupGRPCSidecar(t *testing.T, decide decideFunc, opts ...grpc.ServerOption) (*grpc.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(opts...)
+	sidecarpb.RegisterSidecarServer(server, decide)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	return server, "grpc://" + listener.Addr().String()
+}
+
+func Test_newSidecar(t *testing.T) {
+	tests := []struct {
+		name       string
+		sidecarURL string
+		protocol   string
+		want       Decider
+		wantErr    bool
+	}{
+		{name: "http", sidecarURL: "http://sidecar.localhost", want: &httpSidecar{}},
+		{name: "http json", sidecarURL: "http://sidecar.localhost", protocol: SidecarProtocolJSON, want: &httpSidecar{}},
+		{name: "grpc", sidecarURL: "grpc://sidecar.localhost:9090", want: &grpcSidecar{}},
+		{name: "grpcs", sidecarURL: "grpcs://sidecar.localhost:9090", want: &grpcSidecar{}},
+		{name: "bad protocol", sidecarURL: "http://sidecar.localhost", protocol: "xml", wantErr: true},
+		{name: "bad url", sidecarURL: "sidecar.localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newSidecar(config.Config{SidecarURL: tt.sidecarURL, SidecarProtocol: tt.protocol})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSidecar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("newSidecar() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_grpcSidecar_decide(t *testing.T) {
+	var got *sidecarpb.DecideRequest
+	server, sidecarURL := setupGRPCSidecar(t, func(ctx context.Context, in *sidecarpb.DecideRequest) (*sidecarpb.DecideResponse, error) {
+		got = in
+		switch in.Path {
+		case "/canary":
+			return &sidecarpb.DecideResponse{Target: "Beta", Reason: "beta tester", CacheTtl: 30, SetHeaders: map[string]string{"x-tenant-id": "42"}}, nil
+		case "/nocache":
+			return &sidecarpb.DecideResponse{Target: TargetMain, CacheTtl: -1}, nil
+		case "/empty":
+			return &sidecarpb.DecideResponse{}, nil
+		default:
+			return nil, status.Error(codes.Unavailable, "not ready")
+		}
+	})
+	defer server.Stop()
+
+	sidecar, err := newSidecar(config.Config{SidecarURL: sidecarURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path       string
+		wantTarget string
+		wantReason string
+		wantTTL    int64
+		wantErr    bool
+	}{
+		{path: "/canary", wantTarget: "beta", wantReason: "Sidecar selects beta (beta tester)", wantTTL: 30e9},
+		{path: "/nocache", wantTarget: TargetMain, wantReason: "Sidecar selects main", wantTTL: -1},
+		{path: "/empty", wantErr: true},
+		{path: "/error", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path+"?foo=bar", strings.NewReader("foo bar body"))
+			req.Header.Set("X-Foo", "bar")
+
+			d, err := sidecar.Decide(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decide() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (d.Target != tt.wantTarget || d.Reason != tt.wantReason || int64(d.TTL) != tt.wantTTL) {
+				t.Errorf("decide() = %+v, want target %s, reason %s and ttl %d", d, tt.wantTarget, tt.wantReason, tt.wantTTL)
+			}
+
+			if got.Method != http.MethodPost || got.RawQuery != "foo=bar" || string(got.Body) != "foo bar body" {
+				t.Errorf("Sidecar got request %+v", got)
+			}
+			if len(got.Headers) != 1 || got.Headers[0].Name != "X-Foo" || got.Headers[0].Values[0] != "bar" {
+				t.Errorf("Sidecar got headers %+v", got.Headers)
+			}
+		})
+	}
+}
+
+func Test_grpcSidecar_tls(t *testing.T) {
+	// NOTE: Borrow the self-signed certificate of httptest
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certificate := tlsServer.TLS.Certificates[0]
+	tlsServer.Close()
+
+	server, sidecarURL := setupGRPCSidecar(t, func(ctx context.Context, in *sidecarpb.DecideRequest) (*sidecarpb.DecideResponse, error) {
+		return &sidecarpb.DecideResponse{Target: TargetCanary}, nil
+	}, grpc.Creds(credentials.NewServerTLSFromCert(&certificate)))
+	defer server.Stop()
+
+	address := strings.TrimPrefix(sidecarURL, "grpc://")
+
+	tests := []struct {
+		name       string
+		sidecarURL string
+		tls        config.TLS
+		wantErr    bool
+	}{
+		{name: "grpcs", sidecarURL: "grpcs://" + address, tls: config.TLS{InsecureSkipVerify: true}, wantErr: false},
+		{name: "grpcs with untrusted certificate", sidecarURL: "grpcs://" + address, wantErr: true},
+		{name: "grpc with tls settings", sidecarURL: "grpc://" + address, tls: config.TLS{InsecureSkipVerify: true}, wantErr: false},
+		{name: "grpc without tls", sidecarURL: "grpc://" + address, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Config{SidecarURL: tt.sidecarURL}
+			cfg.Client.Sidecar = config.HTTPClientConfig{Timeout: 1, TLS: tt.tls}
+
+			sidecar, err := newSidecar(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				_ = closeSidecar(sidecar)
+			}()
+
+			_, err = sidecar.Decide(httptest.NewRequest(http.MethodGet, "/", nil))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decide() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Server_Close_grpcSidecar(t *testing.T) {
+	s, err := NewServer(config.Config{
+		MainTarget:   "http://localhost:8081",
+		CanaryTarget: "http://localhost:8082",
+		SidecarURLs:  []string{"http://sidecar-1.localhost", "grpc://sidecar-2.localhost:9090"},
+	}, "some-version")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := s.sidecar.(*sidecarPool).instances[1].sidecar.(*grpcSidecar)
+	if state := sidecar.conn.GetState(); state != connectivity.Shutdown {
+		t.Errorf("Close() did not close the gRPC sidecar connection, its state is %s", state)
+	}
+}
@@ -0,0 +1,102 @@
+package canaryrouter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+const (
+	// SidecarBodyFull sends the whole request body to the sidecar, it is buffered in memory
+	SidecarBodyFull = "full"
+
+	// SidecarBodyHeaders sends no request body to the sidecar, only the method, URL and headers. The
+	// request body streams unbuffered to the selected target.
+	SidecarBodyHeaders = "headers"
+
+	// SidecarBodyPrefix sends the first bytes of the request body to the sidecar, only those are buffered
+	// in memory
+	SidecarBodyPrefix = "prefix"
+)
+
+// errSidecarBodyTooLarge fails the sidecar call when the request body is too large to be buffered
+var errSidecarBodyTooLarge = newSidecarError(sidecarReasonBodyTooLarge, errors.New("Request body exceeds sidecar max body size"))
+
+// sidecarBody reads the part of the request body sent to the sidecar
+type sidecarBody struct {
+	mode       string
+	prefixSize int64
+	maxSize    int64
+}
+
+func newSidecarBody(bodyConfig config.SidecarBody) (*sidecarBody, error) {
+	b := &sidecarBody{
+		mode:       strings.ToLower(bodyConfig.Mode),
+		prefixSize: bodyConfig.PrefixSize,
+		maxSize:    bodyConfig.MaxSize,
+	}
+
+	switch b.mode {
+	case "":
+		b.mode = SidecarBodyFull
+	case SidecarBodyFull, SidecarBodyHeaders:
+	case SidecarBodyPrefix:
+		if b.prefixSize <= 0 {
+			return nil, errors.Errorf("sidecar-body prefix-size must be positive, got %d", b.prefixSize)
+		}
+	default:
+		return nil, errors.Errorf("sidecar-body mode %q is not recognized", bodyConfig.Mode)
+	}
+
+	if b.maxSize < 0 {
+		return nil, errors.Errorf("sidecar-body max-size must be positive, got %d", b.maxSize)
+	}
+
+	return b, nil
+}
+
+// read returns the part of the request body sent to the sidecar. The request body is restored, so that it
+// can still be forwarded as a whole: only the part which has been read is buffered, the rest still streams.
+func (b *sidecarBody) read(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody || b.mode == SidecarBodyHeaders {
+		return nil, nil
+	}
+
+	var reader io.Reader
+	switch b.mode {
+	case SidecarBodyPrefix:
+		reader = io.LimitReader(req.Body, b.prefixSize)
+	default:
+		if b.maxSize > 0 && req.ContentLength > b.maxSize {
+			return nil, errSidecarBodyTooLarge
+		}
+
+		reader = req.Body
+		if b.maxSize > 0 {
+			reader = io.LimitReader(req.Body, b.maxSize+1)
+		}
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	req.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if b.mode == SidecarBodyFull && b.maxSize > 0 && int64(len(body)) > b.maxSize {
+		return nil, errSidecarBodyTooLarge
+	}
+
+	return body, nil
+}
+
+// readCloser reads the buffered part of a body followed by the rest of it, and closes the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,81 @@
+package canaryrouter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newSidecarBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.SidecarBody
+		wantErr bool
+	}{
+		{name: "default", args: config.SidecarBody{}, wantErr: false},
+		{name: "headers", args: config.SidecarBody{Mode: "Headers"}, wantErr: false},
+		{name: "prefix", args: config.SidecarBody{Mode: SidecarBodyPrefix, PrefixSize: 1024}, wantErr: false},
+		{name: "prefix without size", args: config.SidecarBody{Mode: SidecarBodyPrefix}, wantErr: true},
+		{name: "negative max size", args: config.SidecarBody{MaxSize: -1}, wantErr: true},
+		{name: "unknown mode", args: config.SidecarBody{Mode: "stream"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSidecarBody(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSidecarBody() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sidecarBody_read(t *testing.T) {
+	requestBody := "foo bar body"
+
+	tests := []struct {
+		name          string
+		args          config.SidecarBody
+		contentLength int64
+		want          string
+		wantErr       bool
+	}{
+		{name: "full", args: config.SidecarBody{}, contentLength: 12, want: requestBody},
+		{name: "full within max size", args: config.SidecarBody{MaxSize: 12}, contentLength: 12, want: requestBody},
+		{name: "full exceeding max size", args: config.SidecarBody{MaxSize: 11}, contentLength: 12, wantErr: true},
+		{name: "full exceeding max size without content length", args: config.SidecarBody{MaxSize: 11}, contentLength: -1, wantErr: true},
+		{name: "headers", args: config.SidecarBody{Mode: SidecarBodyHeaders}, contentLength: 12, want: ""},
+		{name: "prefix", args: config.SidecarBody{Mode: SidecarBodyPrefix, PrefixSize: 3}, contentLength: 12, want: "foo"},
+		{name: "prefix larger than body", args: config.SidecarBody{Mode: SidecarBodyPrefix, PrefixSize: 100}, contentLength: 12, want: requestBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newSidecarBody(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/foo", strings.NewReader(requestBody))
+			req.ContentLength = tt.contentLength
+
+			got, err := b.read(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read() = %q, want %q", string(got), tt.want)
+			}
+
+			gotRequestBody, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(gotRequestBody) != requestBody {
+				t.Errorf("read() left request body %q, want %q", string(gotRequestBody), requestBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package canaryrouter
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
+)
+
+const (
+	// TargetSidecar is the target tag of the sidecar circuit breaker state
+	TargetSidecar = "sidecar"
+
+	defaultSidecarBreakerCoolDown = 30
+
+	sidecarReasonBreakerOpen = "Sidecar circuit breaker open"
+)
+
+// errSidecarBreakerOpen fails the sidecar call without calling the sidecar while its circuit breaker is open
+var errSidecarBreakerOpen = newSidecarError(sidecarReasonBreakerOpen, errors.New("Sidecar circuit breaker is open"))
+
+// sidecarBreaker skips the sidecar after consecutive failures, so that requests don't wait for the sidecar
+// timeout while it is down. Once the cool-down has elapsed, a single request probes the sidecar: the breaker
+// closes if it succeeds, or opens for another cool-down otherwise.
+type sidecarBreaker struct {
+	sidecar          Decider
+	failureThreshold int
+	coolDown         time.Duration
+	metricCtx        context.Context
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newSidecarBreaker(sidecar Decider, breakerConfig config.SidecarBreaker, metricCtx context.Context) (*sidecarBreaker, error) {
+	if breakerConfig.FailureThreshold < 0 || breakerConfig.CoolDown < 0 {
+		return nil, errors.Errorf("sidecar-circuit-breaker failure-threshold and cool-down must be positive, got %d and %d",
+			breakerConfig.FailureThreshold, breakerConfig.CoolDown)
+	}
+
+	coolDown := breakerConfig.CoolDown
+	if coolDown == 0 {
+		coolDown = defaultSidecarBreakerCoolDown
+	}
+
+	metricCtx, err := instrumentation.AddTargetTag(metricCtx, TargetSidecar)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	b := &sidecarBreaker{
+		sidecar:          sidecar,
+		failureThreshold: breakerConfig.FailureThreshold,
+		coolDown:         time.Duration(coolDown) * time.Second,
+		metricCtx:        metricCtx,
+	}
+	instrumentation.RecordCircuitBreakerState(b.metricCtx, int(breakerClosed))
+
+	return b, nil
+}
+
+func (b *sidecarBreaker) Decide(req *http.Request) (*Decision, error) {
+	if !b.allow(time.Now()) {
+		return nil, errSidecarBreakerOpen
+	}
+
+	d, err := b.sidecar.Decide(req)
+	b.record(err, time.Now())
+
+	return d, err
+}
+
+// allow returns whether the sidecar may be called, which is the probe once the cool-down has elapsed
+func (b *sidecarBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.transition(breakerHalfOpen, now)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *sidecarBreaker) record(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+
+	// NOTE: A request body too large is no outcome of the sidecar, which has not been called. When it is
+	// the probe, the next request probes the sidecar instead.
+	if errors.Cause(err) == errSidecarBodyTooLarge {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		if b.state == breakerHalfOpen {
+			b.transition(breakerClosed, now)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.failureThreshold {
+		b.transition(breakerOpen, now)
+	}
+}
+
+// transition changes the breaker state, b.mu must be held
+func (b *sidecarBreaker) transition(state breakerState, now time.Time) {
+	if state == b.state {
+		return
+	}
+
+	if state == breakerOpen {
+		log.Printf("Sidecar circuit breaker: %s -> %s (%d consecutive failures)", b.state, state, b.failures)
+	} else {
+		log.Printf("Sidecar circuit breaker: %s -> %s", b.state, state)
+	}
+
+	b.state = state
+	if state == breakerOpen {
+		b.openedAt = now
+	}
+
+	instrumentation.RecordCircuitBreakerState(b.metricCtx, int(state))
+}
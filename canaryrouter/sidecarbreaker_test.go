@@ -0,0 +1,132 @@
+package canaryrouter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+// fakeSidecar returns err, and counts its calls
+type fakeSidecar struct {
+	err   error
+	calls int
+}
+
+func (f *fakeSidecar) Decide(req *http.Request) (*Decision, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &Decision{Target: TargetMain}, nil
+}
+
+func Test_newSidecarBreaker(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.SidecarBreaker
+		wantErr bool
+	}{
+		{name: "default cool-down", args: config.SidecarBreaker{FailureThreshold: 3}, wantErr: false},
+		{name: "cool-down", args: config.SidecarBreaker{FailureThreshold: 3, CoolDown: 10}, wantErr: false},
+		{name: "negative threshold", args: config.SidecarBreaker{FailureThreshold: -1}, wantErr: true},
+		{name: "negative cool-down", args: config.SidecarBreaker{FailureThreshold: 3, CoolDown: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSidecarBreaker(&fakeSidecar{}, tt.args, context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSidecarBreaker() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sidecarBreaker(t *testing.T) {
+	sidecar := &fakeSidecar{}
+	b, err := newSidecarBreaker(sidecar, config.SidecarBreaker{FailureThreshold: 2, CoolDown: 10}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	failure := errors.New("connection refused")
+
+	steps := []struct {
+		name      string
+		at        time.Duration
+		err       error
+		wantAllow bool
+		wantState breakerState
+	}{
+		{name: "success", at: 0, wantAllow: true, wantState: breakerClosed},
+		{name: "first failure", at: 1 * time.Second, err: failure, wantAllow: true, wantState: breakerClosed},
+		{name: "body too large is not a failure", at: 1 * time.Second, err: errSidecarBodyTooLarge, wantAllow: true, wantState: breakerClosed},
+		{name: "second failure opens", at: 2 * time.Second, err: failure, wantAllow: true, wantState: breakerOpen},
+		{name: "skipped during cool-down", at: 11 * time.Second, wantAllow: false, wantState: breakerOpen},
+		{name: "failed probe opens again", at: 12 * time.Second, err: failure, wantAllow: true, wantState: breakerOpen},
+		{name: "skipped during new cool-down", at: 21 * time.Second, wantAllow: false, wantState: breakerOpen},
+		{name: "successful probe closes", at: 22 * time.Second, wantAllow: true, wantState: breakerClosed},
+		{name: "failure counted from zero", at: 23 * time.Second, err: failure, wantAllow: true, wantState: breakerClosed},
+	}
+	for _, step := range steps {
+		now := start.Add(step.at)
+
+		allow := b.allow(now)
+		if allow != step.wantAllow {
+			t.Fatalf("%s: allow() = %v, want %v", step.name, allow, step.wantAllow)
+		}
+		if allow {
+			b.record(step.err, now)
+		}
+
+		if b.state != step.wantState {
+			t.Fatalf("%s: state = %v, want %v", step.name, b.state, step.wantState)
+		}
+	}
+}
+
+func Test_sidecarBreaker_decide(t *testing.T) {
+	sidecar := &fakeSidecar{err: errors.New("connection refused")}
+	b, err := newSidecarBreaker(sidecar, config.SidecarBreaker{FailureThreshold: 3}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := b.Decide(httptest.NewRequest(http.MethodGet, "/foo", nil))
+		if i >= 3 && err != errSidecarBreakerOpen {
+			t.Errorf("decide() #%d error = %v, want %v", i, err, errSidecarBreakerOpen)
+		}
+	}
+
+	if sidecar.calls != 3 {
+		t.Errorf("Sidecar got %d calls, want 3", sidecar.calls)
+	}
+}
+
+func Test_sidecarBreaker_halfOpen(t *testing.T) {
+	b, err := newSidecarBreaker(&fakeSidecar{}, config.SidecarBreaker{FailureThreshold: 1, CoolDown: 10}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	b.record(errors.New("timeout"), now)
+
+	if !b.allow(now.Add(10 * time.Second)) {
+		t.Fatalf("allow() = false once the cool-down has elapsed, want true")
+	}
+	if b.allow(now.Add(10 * time.Second)) {
+		t.Errorf("allow() = true while the probe is in-flight, want false")
+	}
+
+	b.record(errSidecarBodyTooLarge, now.Add(10*time.Second))
+	if !b.allow(now.Add(10 * time.Second)) {
+		t.Errorf("allow() = false once the probe did not call the sidecar, want true")
+	}
+}
@@ -0,0 +1,154 @@
+package canaryrouter
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
+)
+
+const (
+	defaultSidecarCacheSize = 10000
+	defaultSidecarCacheTTL  = 60
+
+	sidecarCacheHit  = "hit"
+	sidecarCacheMiss = "miss"
+)
+
+// cacheEntry is a sidecar decision, cached until expiresAt
+type cacheEntry struct {
+	key       string
+	decision  *Decision
+	expiresAt time.Time
+}
+
+// sidecarCache is a LRU cache of the sidecar decisions, keyed by the values of the configured request keys
+type sidecarCache struct {
+	keys []requestKey
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newSidecarCache(cacheConfig config.SidecarCache) (*sidecarCache, error) {
+	c := &sidecarCache{
+		size:    cacheConfig.Size,
+		ttl:     time.Duration(cacheConfig.TTL) * time.Second,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	for i, keyConfig := range cacheConfig.Keys {
+		key, err := newRequestKey(keyConfig)
+		if err != nil {
+			return nil, errors.Annotatef(err, "sidecar-cache keys[%d]", i)
+		}
+		c.keys = append(c.keys, key)
+	}
+
+	if c.size == 0 {
+		c.size = defaultSidecarCacheSize
+	}
+	if c.ttl == 0 {
+		c.ttl = defaultSidecarCacheTTL * time.Second
+	}
+	if c.size < 0 || c.ttl < 0 {
+		return nil, errors.Errorf("sidecar-cache size and ttl must be positive, got %d and %d", cacheConfig.Size, cacheConfig.TTL)
+	}
+
+	return c, nil
+}
+
+// key returns the cache key of the request, or false if one of the request keys is not found
+func (c *sidecarCache) key(req *http.Request) (string, bool) {
+	values := make([]string, 0, len(c.keys))
+	for _, key := range c.keys {
+		value, ok := key.extract(req)
+		if !ok {
+			return "", false
+		}
+		values = append(values, value)
+	}
+
+	return strings.Join(values, "\x00"), true
+}
+
+func (c *sidecarCache) get(key string, now time.Time) (*Decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+
+	return entry.decision, true
+}
+
+// set caches the sidecar decision, for its own ttl if it is provided. Decisions mutating the request are
+// not cached, as the mutations may depend on more than the request keys, e.g. on the request path, and
+// must not be replayed onto other requests.
+func (c *sidecarCache) set(key string, d *Decision, now time.Time) {
+	ttl := d.TTL
+	if ttl < 0 || d.isMutating() {
+		return
+	}
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+
+	entry := &cacheEntry{key: key, decision: d, expiresAt: now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (s *Server) isSidecarCacheEnabled() bool {
+	return s.sidecarCache != nil
+}
+
+func (s *Server) recordSidecarCache(req *http.Request, result string) {
+	ctx, err := instrumentation.AddVersionTag(req.Context(), s.version)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	ctx, err = instrumentation.AddCacheResultTag(ctx, result)
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	instrumentation.RecordSidecarCache(ctx)
+}
@@ -0,0 +1,110 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newSidecarCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.SidecarCache
+		wantErr bool
+	}{
+		{name: "header key", args: config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}}}, wantErr: false},
+		{name: "several keys", args: config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}, {Source: "query", Name: "lang"}}}, wantErr: false},
+		{name: "unknown key source", args: config.SidecarCache{Keys: []config.HashKey{{Source: "body", Name: "id"}}}, wantErr: true},
+		{name: "negative size", args: config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}}, Size: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSidecarCache(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSidecarCache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sidecarCache_key(t *testing.T) {
+	c, err := newSidecarCache(config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}, {Source: "query", Name: "lang"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		query  string
+		want   string
+		wantOk bool
+	}{
+		{name: "all keys", header: "42", query: "?lang=id", want: "42\x00id", wantOk: true},
+		{name: "missing header", query: "?lang=id", wantOk: false},
+		{name: "missing query", header: "42", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/foo"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Customer-Id", tt.header)
+			}
+
+			got, ok := c.key(req)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("key() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_sidecarCache_get(t *testing.T) {
+	now := time.Now()
+
+	c, err := newSidecarCache(config.SidecarCache{Keys: []config.HashKey{{Source: "header", Name: "X-Customer-Id"}}, Size: 2, TTL: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.set("a", &Decision{Target: TargetCanary}, now)
+	c.set("b", &Decision{Target: TargetMain}, now)
+	c.set("no-store", &Decision{Target: TargetMain, TTL: -1}, now)
+	c.set("mutating", &Decision{Target: TargetCanary, RewritePath: "/tenants/42/foo"}, now)
+
+	// "a" is used, so that "b" is the least recently used one when "c" is added
+	if _, ok := c.get("a", now); !ok {
+		t.Fatalf("get() of a cached decision missed")
+	}
+	c.set("c", &Decision{Target: TargetCanary, TTL: 30 * time.Second}, now)
+
+	tests := []struct {
+		name       string
+		key        string
+		at         time.Duration
+		wantTarget string
+		wantOk     bool
+	}{
+		{name: "hit", key: "a", wantTarget: TargetCanary, wantOk: true},
+		{name: "evicted", key: "b", wantOk: false},
+		{name: "not stored", key: "no-store", wantOk: false},
+		{name: "mutating not stored", key: "mutating", wantOk: false},
+		{name: "unknown", key: "d", wantOk: false},
+		{name: "decision ttl overrides ttl", key: "c", at: 20 * time.Second, wantTarget: TargetCanary, wantOk: true},
+		{name: "expired", key: "a", at: 10 * time.Second, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.get(tt.key, now.Add(tt.at))
+			if ok != tt.wantOk {
+				t.Fatalf("get() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && got.Target != tt.wantTarget {
+				t.Errorf("get() target = %s, want %s", got.Target, tt.wantTarget)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package canaryrouter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// SidecarFailureMain routes the request to main when the sidecar fails
+	SidecarFailureMain = "main"
+
+	// SidecarFailureCanary routes the request to the default canary target when the sidecar fails,
+	// circuit breaker limits still apply
+	SidecarFailureCanary = "canary"
+
+	// SidecarFailureReject rejects the request with the configured status code when the sidecar fails
+	SidecarFailureReject = "reject"
+
+	// TargetNone is the target of the rejected requests
+	TargetNone = "none"
+
+	defaultSidecarFailureStatusCode = http.StatusServiceUnavailable
+)
+
+// Reasons of the sidecar failures, reported as the reason tag of the metrics
+const (
+	sidecarReasonTimeout           = "Sidecar timeout"
+	sidecarReasonConnectionRefused = "Sidecar connection refused"
+	sidecarReasonBadStatus         = "Sidecar returns non standard status code"
+	sidecarReasonBadResponse       = "Sidecar returns malformed decision"
+	sidecarReasonBodyTooLarge      = "Request body exceeds sidecar max body size"
+	sidecarReasonError             = "Sidecar error"
+)
+
+// sidecarError is a sidecar failure along with its reason
+type sidecarError struct {
+	reason string
+	err    error
+}
+
+func (e *sidecarError) Error() string {
+	return e.err.Error()
+}
+
+func newSidecarError(reason string, err error) error {
+	return &sidecarError{reason: reason, err: err}
+}
+
+// sidecarFailureReason returns the reason of a sidecar failure, classifying the errors of the sidecar call
+func sidecarFailureReason(err error) string {
+	err = errors.Cause(err)
+
+	if sidecarErr, ok := err.(*sidecarError); ok {
+		return sidecarErr.reason
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+
+	if err == context.DeadlineExceeded {
+		return sidecarReasonTimeout
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return sidecarReasonTimeout
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		if syscallErr, ok := opErr.Err.(*os.SyscallError); ok && syscallErr.Err == syscall.ECONNREFUSED {
+			return sidecarReasonConnectionRefused
+		}
+	}
+
+	if grpcStatus, ok := status.FromError(err); ok {
+		switch grpcStatus.Code() {
+		case codes.DeadlineExceeded:
+			return sidecarReasonTimeout
+		case codes.Unavailable:
+			return sidecarReasonConnectionRefused
+		}
+	}
+
+	return sidecarReasonError
+}
+
+// sidecarFailure routes the requests for which the sidecar failed
+type sidecarFailure struct {
+	policy     string
+	statusCode int
+}
+
+func newSidecarFailure(failureConfig config.SidecarFailure) (*sidecarFailure, error) {
+	f := &sidecarFailure{
+		policy:     strings.ToLower(failureConfig.Policy),
+		statusCode: failureConfig.StatusCode,
+	}
+
+	switch f.policy {
+	case "":
+		f.policy = SidecarFailureMain
+	case SidecarFailureMain, SidecarFailureCanary, SidecarFailureReject:
+	default:
+		return nil, errors.Errorf("sidecar-failure policy %q is not recognized", failureConfig.Policy)
+	}
+
+	if f.statusCode == 0 {
+		f.statusCode = defaultSidecarFailureStatusCode
+	}
+	if f.statusCode < 100 || f.statusCode > 599 {
+		return nil, errors.Errorf("sidecar-failure status-code %d is not a valid status code", f.statusCode)
+	}
+
+	return f, nil
+}
+
+// serveSidecarFailure routes the request according to the sidecar failure policy. Requests with a body
+// exceeding the sidecar max body size are always routed to main, as the sidecar has not failed.
+func (s *Server) serveSidecarFailure(w http.ResponseWriter, req *http.Request, err error) {
+	reason := sidecarFailureReason(err)
+
+	if errors.Cause(err) == errSidecarBodyTooLarge {
+		req = setRoutingReason(req, reason)
+		s.serveMain(w, req)
+		return
+	}
+
+	switch s.sidecarFailure.policy {
+	case SidecarFailureCanary:
+		s.serveCanaryWithinLimit(w, req, s.defaultCanary(), reason+", fallback to canary")
+	case SidecarFailureReject:
+		req = setRoutingReason(req, "%s, rejected", reason)
+		defer s.recordMetricTarget(req.Context(), TargetNone)
+
+		http.Error(w, http.StatusText(s.sidecarFailure.statusCode), s.sidecarFailure.statusCode)
+	default:
+		req = setRoutingReason(req, reason)
+		s.serveMain(w, req)
+	}
+}
@@ -0,0 +1,89 @@
+package canaryrouter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// timeoutError is a net.Error which timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_sidecarFailureReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "response header timeout", err: timeoutError{}, want: sidecarReasonTimeout},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: sidecarReasonTimeout},
+		{
+			name: "connection refused",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}},
+			want: sidecarReasonConnectionRefused,
+		},
+		{name: "grpc deadline exceeded", err: status.Error(codes.DeadlineExceeded, "deadline"), want: sidecarReasonTimeout},
+		{name: "grpc unavailable", err: status.Error(codes.Unavailable, "connection refused"), want: sidecarReasonConnectionRefused},
+		{name: "grpc internal", err: status.Error(codes.Internal, "panic"), want: sidecarReasonError},
+		{name: "bad status", err: newSidecarError(sidecarReasonBadStatus, errors.New("500")), want: sidecarReasonBadStatus},
+		{name: "body too large", err: errSidecarBodyTooLarge, want: sidecarReasonBodyTooLarge},
+		{name: "other", err: errors.New("unexpected EOF"), want: sidecarReasonError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sidecarFailureReason(tt.err); got != tt.want {
+				t.Errorf("sidecarFailureReason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_httpSidecar_decide_connectionRefused(t *testing.T) {
+	closedSidecar := httptest.NewServer(http.NotFoundHandler())
+	closedSidecar.Close()
+
+	sidecar, err := newSidecar(config.Config{SidecarURL: closedSidecar.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sidecar.Decide(httptest.NewRequest(http.MethodGet, "/foo", nil))
+	if got := sidecarFailureReason(err); got != sidecarReasonConnectionRefused {
+		t.Errorf("sidecarFailureReason() = %v, want %v (%v)", got, sidecarReasonConnectionRefused, err)
+	}
+}
+
+func Test_newSidecarFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.SidecarFailure
+		wantErr bool
+	}{
+		{name: "default", args: config.SidecarFailure{}, wantErr: false},
+		{name: "canary", args: config.SidecarFailure{Policy: "Canary"}, wantErr: false},
+		{name: "reject", args: config.SidecarFailure{Policy: SidecarFailureReject, StatusCode: http.StatusForbidden}, wantErr: false},
+		{name: "unknown policy", args: config.SidecarFailure{Policy: "retry"}, wantErr: true},
+		{name: "bad status code", args: config.SidecarFailure{Policy: SidecarFailureReject, StatusCode: 42}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSidecarFailure(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSidecarFailure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
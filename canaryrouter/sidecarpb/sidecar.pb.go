@@ -0,0 +1,367 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: canaryrouter/sidecarpb/sidecar.proto
+
+package sidecarpb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+// Header is a request header along with all of its values
+type Header struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Values               []string `protobuf:"bytes,2,rep,name=values,proto3" json:"values,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Header) Reset()         { *m = Header{} }
+func (m *Header) String() string { return proto.CompactTextString(m) }
+func (*Header) ProtoMessage()    {}
+func (*Header) Descriptor() ([]byte, []int) {
+	return fileDescriptor_49ee911437f96e75, []int{0}
+}
+
+func (m *Header) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Header.Unmarshal(m, b)
+}
+func (m *Header) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Header.Marshal(b, m, deterministic)
+}
+func (m *Header) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Header.Merge(m, src)
+}
+func (m *Header) XXX_Size() int {
+	return xxx_messageInfo_Header.Size(m)
+}
+func (m *Header) XXX_DiscardUnknown() {
+	xxx_messageInfo_Header.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Header proto.InternalMessageInfo
+
+func (m *Header) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Header) GetValues() []string {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+// DecideRequest is the request to be routed, after trim-prefix
+type DecideRequest struct {
+	Method   string    `protobuf:"bytes,1,opt,name=method,proto3" json:"method,omitempty"`
+	Host     string    `protobuf:"bytes,2,opt,name=host,proto3" json:"host,omitempty"`
+	Path     string    `protobuf:"bytes,3,opt,name=path,proto3" json:"path,omitempty"`
+	RawQuery string    `protobuf:"bytes,4,opt,name=raw_query,json=rawQuery,proto3" json:"raw_query,omitempty"`
+	Headers  []*Header `protobuf:"bytes,5,rep,name=headers,proto3" json:"headers,omitempty"`
+	// body is empty for requests without body
+	Body                 []byte   `protobuf:"bytes,6,opt,name=body,proto3" json:"body,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DecideRequest) Reset()         { *m = DecideRequest{} }
+func (m *DecideRequest) String() string { return proto.CompactTextString(m) }
+func (*DecideRequest) ProtoMessage()    {}
+func (*DecideRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_49ee911437f96e75, []int{1}
+}
+
+func (m *DecideRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DecideRequest.Unmarshal(m, b)
+}
+func (m *DecideRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DecideRequest.Marshal(b, m, deterministic)
+}
+func (m *DecideRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DecideRequest.Merge(m, src)
+}
+func (m *DecideRequest) XXX_Size() int {
+	return xxx_messageInfo_DecideRequest.Size(m)
+}
+func (m *DecideRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DecideRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DecideRequest proto.InternalMessageInfo
+
+func (m *DecideRequest) GetMethod() string {
+	if m != nil {
+		return m.Method
+	}
+	return ""
+}
+
+func (m *DecideRequest) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *DecideRequest) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *DecideRequest) GetRawQuery() string {
+	if m != nil {
+		return m.RawQuery
+	}
+	return ""
+}
+
+func (m *DecideRequest) GetHeaders() []*Header {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+func (m *DecideRequest) GetBody() []byte {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+// DecideResponse is the routing decision, same as the JSON decision of the HTTP sidecar
+type DecideResponse struct {
+	// target is the name of the target the request is forwarded to, "main", "canary" or the name of
+	// another canary target
+	Target string `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	// reason explains the decision, it is reported as the reason tag of the metrics so it should only
+	// take a few distinct values
+	Reason string `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	// cache_ttl is how long (in seconds) the decision may be cached by the sidecar cache. The sidecar
+	// cache ttl is used if it is 0, and a negative value prevents caching.
+	CacheTtl int32 `protobuf:"varint,3,opt,name=cache_ttl,json=cacheTtl,proto3" json:"cache_ttl,omitempty"`
+	// set_headers are the request headers to set before forwarding the request
+	SetHeaders map[string]string `protobuf:"bytes,4,rep,name=set_headers,json=setHeaders,proto3" json:"set_headers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// remove_headers are the request headers to remove before forwarding the request
+	RemoveHeaders []string `protobuf:"bytes,5,rep,name=remove_headers,json=removeHeaders,proto3" json:"remove_headers,omitempty"`
+	// rewrite_path if set rewrites the request path before forwarding the request
+	RewritePath          string   `protobuf:"bytes,6,opt,name=rewrite_path,json=rewritePath,proto3" json:"rewrite_path,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DecideResponse) Reset()         { *m = DecideResponse{} }
+func (m *DecideResponse) String() string { return proto.CompactTextString(m) }
+func (*DecideResponse) ProtoMessage()    {}
+func (*DecideResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_49ee911437f96e75, []int{2}
+}
+
+func (m *DecideResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DecideResponse.Unmarshal(m, b)
+}
+func (m *DecideResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DecideResponse.Marshal(b, m, deterministic)
+}
+func (m *DecideResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DecideResponse.Merge(m, src)
+}
+func (m *DecideResponse) XXX_Size() int {
+	return xxx_messageInfo_DecideResponse.Size(m)
+}
+func (m *DecideResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DecideResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DecideResponse proto.InternalMessageInfo
+
+func (m *DecideResponse) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+func (m *DecideResponse) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+func (m *DecideResponse) GetCacheTtl() int32 {
+	if m != nil {
+		return m.CacheTtl
+	}
+	return 0
+}
+
+func (m *DecideResponse) GetSetHeaders() map[string]string {
+	if m != nil {
+		return m.SetHeaders
+	}
+	return nil
+}
+
+func (m *DecideResponse) GetRemoveHeaders() []string {
+	if m != nil {
+		return m.RemoveHeaders
+	}
+	return nil
+}
+
+func (m *DecideResponse) GetRewritePath() string {
+	if m != nil {
+		return m.RewritePath
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*Header)(nil), "canaryrouter.sidecar.Header")
+	proto.RegisterType((*DecideRequest)(nil), "canaryrouter.sidecar.DecideRequest")
+	proto.RegisterType((*DecideResponse)(nil), "canaryrouter.sidecar.DecideResponse")
+	proto.RegisterMapType((map[string]string)(nil), "canaryrouter.sidecar.DecideResponse.SetHeadersEntry")
+}
+
+func init() {
+	proto.RegisterFile("canaryrouter/sidecarpb/sidecar.proto", fileDescriptor_49ee911437f96e75)
+}
+
+var fileDescriptor_49ee911437f96e75 = []byte{
+	// 427 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x92, 0x4f, 0x6f, 0xd3, 0x40,
+	0x10, 0xc5, 0xe5, 0xfc, 0x71, 0x9b, 0x49, 0x5b, 0xd0, 0xaa, 0x42, 0x56, 0xe1, 0x10, 0x42, 0x91,
+	0x72, 0xa9, 0x23, 0x95, 0x0a, 0x21, 0x10, 0x17, 0x44, 0x05, 0x47, 0x70, 0xe0, 0xc2, 0x01, 0x6b,
+	0x6d, 0x8f, 0x6a, 0xab, 0x89, 0xd7, 0x9d, 0x1d, 0x37, 0xf2, 0x37, 0xe3, 0xc2, 0x77, 0x43, 0xfb,
+	0xc7, 0x55, 0x41, 0x11, 0xea, 0xed, 0xcd, 0xf3, 0xec, 0xee, 0xef, 0x8d, 0x07, 0x4e, 0x73, 0x59,
+	0x4b, 0xea, 0x48, 0xb5, 0x8c, 0xb4, 0xd4, 0x55, 0x81, 0xb9, 0xa4, 0x26, 0xeb, 0x55, 0xdc, 0x90,
+	0x62, 0x25, 0x8e, 0xef, 0x77, 0xc5, 0xfe, 0xdb, 0xfc, 0x02, 0xc2, 0xcf, 0x28, 0x0b, 0x24, 0x21,
+	0x60, 0x54, 0xcb, 0x0d, 0x46, 0xc1, 0x2c, 0x58, 0x4c, 0x12, 0xab, 0xc5, 0x13, 0x08, 0x6f, 0xe5,
+	0xba, 0x45, 0x1d, 0x0d, 0x66, 0xc3, 0xc5, 0x24, 0xf1, 0xd5, 0xfc, 0x57, 0x00, 0x87, 0x1f, 0x31,
+	0xaf, 0x0a, 0x4c, 0xf0, 0xa6, 0x45, 0xcd, 0xa6, 0x73, 0x83, 0x5c, 0xaa, 0xc2, 0x9f, 0xf7, 0x95,
+	0xb9, 0xb5, 0x54, 0x9a, 0xa3, 0x81, 0xbb, 0xd5, 0x68, 0xe3, 0x35, 0x92, 0xcb, 0x68, 0xe8, 0x3c,
+	0xa3, 0xc5, 0x53, 0x98, 0x90, 0xdc, 0xa6, 0x37, 0x2d, 0x52, 0x17, 0x8d, 0xec, 0x87, 0x7d, 0x92,
+	0xdb, 0xaf, 0xa6, 0x16, 0xaf, 0x61, 0xaf, 0xb4, 0x90, 0x3a, 0x1a, 0xcf, 0x86, 0x8b, 0xe9, 0xf9,
+	0xb3, 0x78, 0x57, 0x98, 0xd8, 0x25, 0x49, 0xfa, 0x66, 0xf3, 0x50, 0xa6, 0x8a, 0x2e, 0x0a, 0x67,
+	0xc1, 0xe2, 0x20, 0xb1, 0x7a, 0xfe, 0x7b, 0x00, 0x47, 0x3d, 0xba, 0x6e, 0x54, 0xad, 0x6d, 0x4a,
+	0x96, 0x74, 0x85, 0xdc, 0xb3, 0xbb, 0xca, 0xf8, 0x84, 0x52, 0xab, 0xda, 0xd3, 0xfb, 0xca, 0xb0,
+	0xe6, 0x32, 0x2f, 0x31, 0x65, 0x5e, 0xdb, 0x10, 0xe3, 0x64, 0xdf, 0x1a, 0xdf, 0x78, 0x2d, 0xbe,
+	0xc3, 0x54, 0x23, 0xa7, 0x3d, 0xef, 0xc8, 0xf2, 0x5e, 0xec, 0xe6, 0xfd, 0x9b, 0x23, 0x5e, 0x21,
+	0xbb, 0x04, 0xfa, 0xb2, 0x66, 0xea, 0x12, 0xd0, 0x77, 0x86, 0x78, 0x09, 0x47, 0x84, 0x1b, 0x75,
+	0x8b, 0xe9, 0xfd, 0x49, 0x4c, 0x92, 0x43, 0xe7, 0xf6, 0x6d, 0xcf, 0xe1, 0x80, 0x70, 0x4b, 0x15,
+	0x63, 0x6a, 0x47, 0x1c, 0x5a, 0xf0, 0xa9, 0xf7, 0xbe, 0x48, 0x2e, 0x4f, 0xde, 0xc3, 0xa3, 0x7f,
+	0x1e, 0x12, 0x8f, 0x61, 0x78, 0x8d, 0x9d, 0x4f, 0x6f, 0xa4, 0x38, 0x86, 0xb1, 0xfd, 0xd5, 0x3e,
+	0xb9, 0x2b, 0xde, 0x0e, 0xde, 0x04, 0xe7, 0x3f, 0x61, 0x6f, 0xe5, 0xf0, 0xc5, 0x0a, 0x42, 0x97,
+	0x40, 0xbc, 0xf8, 0x7f, 0x3e, 0xbb, 0x22, 0x27, 0xa7, 0x0f, 0x19, 0xc2, 0x87, 0x4f, 0x3f, 0x2e,
+	0xaf, 0x2a, 0x2e, 0xdb, 0x2c, 0xce, 0xd5, 0x66, 0xc9, 0xd5, 0x35, 0xf2, 0xd9, 0xba, 0xca, 0x08,
+	0x97, 0xee, 0xf4, 0x99, 0x5f, 0xf3, 0xdd, 0x3b, 0xff, 0xee, 0x4e, 0x65, 0xa1, 0x5d, 0xfb, 0x57,
+	0x7f, 0x06, 0x00, 0xa9, 0x33, 0xd8, 0x2d, 0x1e, 0x03, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// SidecarClient is the client API for Sidecar service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type SidecarClient interface {
+	// Decide returns the routing decision of a request
+	Decide(ctx context.Context, in *DecideRequest, opts ...grpc.CallOption) (*DecideResponse, error)
+}
+
+type sidecarClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewSidecarClient(cc *grpc.ClientConn) SidecarClient {
+	return &sidecarClient{cc}
+}
+
+func (c *sidecarClient) Decide(ctx context.Context, in *DecideRequest, opts ...grpc.CallOption) (*DecideResponse, error) {
+	out := new(DecideResponse)
+	err := c.cc.Invoke(ctx, "/canaryrouter.sidecar.Sidecar/Decide", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SidecarServer is the server API for Sidecar service.
+type SidecarServer interface {
+	// Decide returns the routing decision of a request
+	Decide(context.Context, *DecideRequest) (*DecideResponse, error)
+}
+
+// UnimplementedSidecarServer can be embedded to have forward compatible implementations.
+type UnimplementedSidecarServer struct {
+}
+
+func (*UnimplementedSidecarServer) Decide(ctx context.Context, req *DecideRequest) (*DecideResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Decide not implemented")
+}
+
+func RegisterSidecarServer(s *grpc.Server, srv SidecarServer) {
+	s.RegisterService(&_Sidecar_serviceDesc, srv)
+}
+
+func _Sidecar_Decide_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DecideRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SidecarServer).Decide(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/canaryrouter.sidecar.Sidecar/Decide",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SidecarServer).Decide(ctx, req.(*DecideRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Sidecar_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "canaryrouter.sidecar.Sidecar",
+	HandlerType: (*SidecarServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Decide",
+			Handler:    _Sidecar_Decide_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "canaryrouter/sidecarpb/sidecar.proto",
+}
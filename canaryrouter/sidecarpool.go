@@ -0,0 +1,211 @@
+package canaryrouter
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+const (
+	// SidecarBalancerRoundRobin selects the sidecar instances in turn
+	SidecarBalancerRoundRobin = "round-robin"
+
+	// SidecarBalancerLeastLoaded selects the sidecar instance with the fewest in-flight calls
+	SidecarBalancerLeastLoaded = "least-loaded"
+
+	defaultSidecarMaxAttempts   = 2
+	defaultSidecarEjectAfter    = 3
+	defaultSidecarEjectDuration = 30
+)
+
+// sidecarInstance is one of the sidecar instances of a pool
+type sidecarInstance struct {
+	url      string
+	sidecar  Decider
+	inflight int64
+
+	// failures and ejectedUntil are guarded by the pool mutex
+	failures     int
+	ejectedUntil time.Time
+}
+
+// sidecarPool load balances the sidecar calls across several sidecar instances. An instance failing
+// consecutively is ejected for a while, and a failed call is retried on a different instance as long as
+// the timeout budget allows it.
+type sidecarPool struct {
+	instances     []*sidecarInstance
+	mode          string
+	maxAttempts   int
+	ejectAfter    int
+	ejectDuration time.Duration
+	timeout       time.Duration
+
+	next uint64
+	mu   sync.Mutex
+}
+
+func newSidecarPool(cfg config.Config, body *sidecarBody) (*sidecarPool, error) {
+	balancerConfig := cfg.SidecarBalancer
+
+	p := &sidecarPool{
+		mode:          strings.ToLower(balancerConfig.Mode),
+		maxAttempts:   balancerConfig.MaxAttempts,
+		ejectAfter:    balancerConfig.EjectAfter,
+		ejectDuration: time.Duration(balancerConfig.EjectDuration) * time.Second,
+		timeout:       time.Duration(cfg.Client.Sidecar.Timeout) * time.Second,
+	}
+
+	switch p.mode {
+	case "":
+		p.mode = SidecarBalancerRoundRobin
+	case SidecarBalancerRoundRobin, SidecarBalancerLeastLoaded:
+	default:
+		return nil, errors.Errorf("sidecar-balancer mode %q is not recognized", balancerConfig.Mode)
+	}
+
+	if p.maxAttempts == 0 {
+		p.maxAttempts = defaultSidecarMaxAttempts
+	}
+	if p.ejectAfter == 0 {
+		p.ejectAfter = defaultSidecarEjectAfter
+	}
+	if p.ejectDuration == 0 {
+		p.ejectDuration = defaultSidecarEjectDuration * time.Second
+	}
+	if p.maxAttempts < 0 || p.ejectAfter < 0 || p.ejectDuration < 0 {
+		return nil, errors.Errorf("sidecar-balancer max-attempts, eject-after and eject-duration must be positive, got %d, %d and %d",
+			balancerConfig.MaxAttempts, balancerConfig.EjectAfter, balancerConfig.EjectDuration)
+	}
+
+	for _, sidecarURL := range cfg.SidecarURLs {
+		sidecar, err := newSidecarInstance(sidecarURL, cfg, body)
+		if err != nil {
+			_ = p.close()
+			return nil, errors.Annotate(err, "sidecar-urls")
+		}
+		p.instances = append(p.instances, &sidecarInstance{url: sidecarURL, sidecar: sidecar})
+	}
+
+	return p, nil
+}
+
+// close closes the connections of the sidecar instances
+func (p *sidecarPool) close() error {
+	var firstErr error
+	for _, instance := range p.instances {
+		if err := closeSidecar(instance.sidecar); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (p *sidecarPool) Decide(req *http.Request) (*Decision, error) {
+	outreq := req
+	if p.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), p.timeout)
+		defer cancel()
+		outreq = req.WithContext(ctx)
+
+		// NOTE: The sidecar restores the body of outreq once it has read it
+		defer func() {
+			req.Body = outreq.Body
+		}()
+	}
+
+	tried := make(map[*sidecarInstance]bool, p.maxAttempts)
+
+	var err error
+	for attempt := 0; attempt < p.maxAttempts && attempt < len(p.instances); attempt++ {
+		if attempt > 0 && outreq.Context().Err() != nil {
+			break
+		}
+
+		instance := p.pick(tried, time.Now())
+		tried[instance] = true
+
+		atomic.AddInt64(&instance.inflight, 1)
+		var d *Decision
+		d, err = instance.sidecar.Decide(outreq)
+		atomic.AddInt64(&instance.inflight, -1)
+
+		// NOTE: A request body too large fails whatever the instance
+		if errors.Cause(err) == errSidecarBodyTooLarge {
+			return nil, err
+		}
+
+		p.record(instance, err, time.Now())
+		if err == nil {
+			return d, nil
+		}
+
+		log.WithField("proxy", "sidecar").Infof("Sidecar %s failed: %v", instance.url, err)
+	}
+
+	return nil, err
+}
+
+// pick selects an instance which has not been tried yet, among the instances which are not ejected if any
+func (p *sidecarPool) pick(tried map[*sidecarInstance]bool, now time.Time) *sidecarInstance {
+	p.mu.Lock()
+	candidates := make([]*sidecarInstance, 0, len(p.instances))
+	ejected := make([]*sidecarInstance, 0)
+
+	start := int(atomic.AddUint64(&p.next, 1) - 1)
+	for i := range p.instances {
+		instance := p.instances[(start+i)%len(p.instances)]
+		switch {
+		case tried[instance]:
+		case now.Before(instance.ejectedUntil):
+			ejected = append(ejected, instance)
+		default:
+			candidates = append(candidates, instance)
+		}
+	}
+	p.mu.Unlock()
+
+	// NOTE: When all the remaining instances are ejected, they are still called rather than failing
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+
+	if p.mode == SidecarBalancerLeastLoaded {
+		selected := candidates[0]
+		for _, instance := range candidates[1:] {
+			if atomic.LoadInt64(&instance.inflight) < atomic.LoadInt64(&selected.inflight) {
+				selected = instance
+			}
+		}
+		return selected
+	}
+
+	return candidates[0]
+}
+
+// record ejects the instance once it has failed p.ejectAfter consecutive times
+func (p *sidecarPool) record(instance *sidecarInstance, err error, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		instance.failures = 0
+		return
+	}
+
+	instance.failures++
+	if instance.failures >= p.ejectAfter {
+		if !now.Before(instance.ejectedUntil) {
+			log.Printf("Sidecar %s ejected for %s (%d consecutive failures)", instance.url, p.ejectDuration, instance.failures)
+		}
+		instance.failures = 0
+		instance.ejectedUntil = now.Add(p.ejectDuration)
+	}
+}
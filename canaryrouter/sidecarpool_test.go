@@ -0,0 +1,125 @@
+package canaryrouter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func newTestSidecarPool(t *testing.T, balancerConfig config.SidecarBalancer, sidecars ...*fakeSidecar) *sidecarPool {
+	t.Helper()
+
+	cfg := config.Config{SidecarBalancer: balancerConfig}
+	for range sidecars {
+		cfg.SidecarURLs = append(cfg.SidecarURLs, "http://sidecar.localhost")
+	}
+
+	p, err := newSidecarPool(cfg, &sidecarBody{mode: SidecarBodyFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, sidecar := range sidecars {
+		p.instances[i].sidecar = sidecar
+	}
+
+	return p
+}
+
+func Test_newSidecarPool(t *testing.T) {
+	sidecarURLs := []string{"http://sidecar-1.localhost", "grpc://sidecar-2.localhost:9090"}
+
+	tests := []struct {
+		name    string
+		args    config.Config
+		wantErr bool
+	}{
+		{name: "default", args: config.Config{SidecarURLs: sidecarURLs}, wantErr: false},
+		{name: "least-loaded", args: config.Config{SidecarURLs: sidecarURLs, SidecarBalancer: config.SidecarBalancer{Mode: "Least-Loaded"}}, wantErr: false},
+		{name: "unknown mode", args: config.Config{SidecarURLs: sidecarURLs, SidecarBalancer: config.SidecarBalancer{Mode: "random"}}, wantErr: true},
+		{name: "negative max-attempts", args: config.Config{SidecarURLs: sidecarURLs, SidecarBalancer: config.SidecarBalancer{MaxAttempts: -1}}, wantErr: true},
+		{name: "bad url", args: config.Config{SidecarURLs: []string{"sidecar.localhost"}}, wantErr: true},
+		{name: "with sidecar-url", args: config.Config{SidecarURL: "http://sidecar.localhost", SidecarURLs: sidecarURLs}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSidecar(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSidecar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sidecarPool_roundRobin(t *testing.T) {
+	sidecars := []*fakeSidecar{{}, {}, {}}
+	p := newTestSidecarPool(t, config.SidecarBalancer{}, sidecars...)
+
+	for i := 0; i < 6; i++ {
+		if _, err := p.Decide(httptest.NewRequest(http.MethodGet, "/foo", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, sidecar := range sidecars {
+		if sidecar.calls != 2 {
+			t.Errorf("Sidecar #%d got %d calls, want 2", i, sidecar.calls)
+		}
+	}
+}
+
+func Test_sidecarPool_leastLoaded(t *testing.T) {
+	p := newTestSidecarPool(t, config.SidecarBalancer{Mode: SidecarBalancerLeastLoaded}, &fakeSidecar{}, &fakeSidecar{}, &fakeSidecar{})
+	p.instances[0].inflight = 2
+	p.instances[1].inflight = 1
+	p.instances[2].inflight = 3
+
+	for i := 0; i < 3; i++ {
+		if got := p.pick(map[*sidecarInstance]bool{}, time.Now()); got != p.instances[1] {
+			t.Errorf("pick() #%d = %s with %d in-flight calls, want the least loaded instance", i, got.url, got.inflight)
+		}
+	}
+}
+
+func Test_sidecarPool_retryAndEject(t *testing.T) {
+	failing, healthy := &fakeSidecar{err: errors.New("connection refused")}, &fakeSidecar{}
+	p := newTestSidecarPool(t, config.SidecarBalancer{EjectAfter: 2}, failing, healthy)
+
+	for i := 0; i < 10; i++ {
+		if _, err := p.Decide(httptest.NewRequest(http.MethodGet, "/foo", nil)); err != nil {
+			t.Errorf("decide() #%d error = %v, want retried on the healthy instance", i, err)
+		}
+	}
+
+	if failing.calls != 2 {
+		t.Errorf("Failing sidecar got %d calls, want 2 before being ejected", failing.calls)
+	}
+	if healthy.calls != 10 {
+		t.Errorf("Healthy sidecar got %d calls, want 10", healthy.calls)
+	}
+}
+
+func Test_sidecarPool_allFailing(t *testing.T) {
+	failure := errors.New("connection refused")
+	sidecars := []*fakeSidecar{{err: failure}, {err: failure}, {err: failure}}
+	p := newTestSidecarPool(t, config.SidecarBalancer{MaxAttempts: 2, EjectAfter: 1}, sidecars...)
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Decide(httptest.NewRequest(http.MethodGet, "/foo", nil)); err != failure {
+			t.Errorf("decide() #%d error = %v, want %v", i, err, failure)
+		}
+	}
+
+	// NOTE: Every request makes 2 attempts, the instances being still called once all of them are ejected
+	calls := 0
+	for _, sidecar := range sidecars {
+		calls += sidecar.calls
+	}
+	if calls != 6 {
+		t.Errorf("Sidecars got %d calls, want 6", calls)
+	}
+}
@@ -0,0 +1,178 @@
+package canaryrouter
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+const (
+	// SplitModeRandom selects canary requests randomly according to the canary weight
+	SplitModeRandom = "random"
+
+	// SplitModeDeterministic selects canary requests evenly spread according to the canary weight,
+	// e.g. weight 25 forwards exactly every 4th request to canary
+	SplitModeDeterministic = "deterministic"
+
+	// SplitModeHash selects canary requests by hashing a request key into buckets, so that the same
+	// key is always forwarded to the same target for a given canary weight
+	SplitModeHash = "hash"
+
+	// HashKeySourceHeader extracts the hash key from a request header
+	HashKeySourceHeader = "header"
+	// HashKeySourceCookie extracts the hash key from a request cookie
+	HashKeySourceCookie = "cookie"
+	// HashKeySourceQuery extracts the hash key from a request query param
+	HashKeySourceQuery = "query"
+	// HashKeySourcePath extracts the hash key from a request path segment
+	HashKeySourcePath = "path"
+
+	// splitScale is the resolution of the canary weight, in basis points. It is also the number of
+	// buckets used by the hash mode.
+	splitScale = 10000
+)
+
+type splitter struct {
+	// weight is the canary weight in basis points (0-10000), it is accessed atomically
+	// as it may be changed by a ramp
+	weight uint64
+	mode   string
+
+	hashKey requestKey
+
+	counter uint64
+}
+
+func newSplitter(splitConfig config.Split) (*splitter, error) {
+	weight, err := toBasisPoints(valueOf(splitConfig.CanaryWeight))
+	if err != nil {
+		return nil, errors.Annotate(err, "split canary-weight")
+	}
+
+	sp := &splitter{
+		weight: weight,
+		mode:   splitConfig.Mode,
+	}
+
+	switch sp.mode {
+	case "":
+		sp.mode = SplitModeRandom
+	case SplitModeRandom, SplitModeDeterministic:
+	case SplitModeHash:
+		hashKey, err := newRequestKey(splitConfig.HashKey)
+		if err != nil {
+			return nil, errors.Annotate(err, "split")
+		}
+		sp.hashKey = hashKey
+	default:
+		return nil, errors.Errorf("split mode %q is not recognized", sp.mode)
+	}
+
+	return sp, nil
+}
+
+// toBasisPoints converts a canary weight percentage to basis points
+func toBasisPoints(canaryWeight float64) (uint64, error) {
+	if canaryWeight < 0 || canaryWeight > 100 {
+		return 0, errors.Errorf("must be between 0 and 100, got %v", canaryWeight)
+	}
+
+	return uint64(math.Round(canaryWeight * splitScale / 100)), nil
+}
+
+func (sp *splitter) setWeight(weight uint64) {
+	atomic.StoreUint64(&sp.weight, weight)
+}
+
+// toCanary decides whether the request should be forwarded to canary
+func (sp *splitter) toCanary(req *http.Request) (bool, error) {
+	weight := atomic.LoadUint64(&sp.weight)
+
+	switch sp.mode {
+	case SplitModeDeterministic:
+		// Forward to canary whenever the accumulated canary share crosses a whole request
+		n := atomic.AddUint64(&sp.counter, 1)
+		return (n*weight)/splitScale != ((n-1)*weight)/splitScale, nil
+	case SplitModeHash:
+		key, ok := sp.extractHashKey(req)
+		if !ok {
+			return false, errors.Errorf("hash key %s %q not found", sp.hashKey.Source, sp.hashKey.Name)
+		}
+
+		return hashBucket(key) < weight, nil
+	default:
+		return uint64(rand.Intn(splitScale)) < weight, nil
+	}
+}
+
+func (sp *splitter) extractHashKey(req *http.Request) (string, bool) {
+	return sp.hashKey.extract(req)
+}
+
+// requestKey is a value extracted from the request, such as the hash key of the split
+type requestKey struct {
+	config.HashKey
+
+	pathSegment int
+}
+
+func newRequestKey(hashKey config.HashKey) (requestKey, error) {
+	key := requestKey{HashKey: hashKey}
+
+	switch hashKey.Source {
+	case HashKeySourceHeader, HashKeySourceCookie, HashKeySourceQuery:
+		if hashKey.Name == "" {
+			return key, errors.Errorf("hash-key name must not be empty for %q source", hashKey.Source)
+		}
+	case HashKeySourcePath:
+		segment, err := strconv.Atoi(hashKey.Name)
+		if err != nil || segment < 0 {
+			return key, errors.Errorf("hash-key name must be a path segment index for %q source, got %q", hashKey.Source, hashKey.Name)
+		}
+		key.pathSegment = segment
+	default:
+		return key, errors.Errorf("hash-key source %q is not recognized", hashKey.Source)
+	}
+
+	return key, nil
+}
+
+// extract returns the value of the key in the request, or false if it is not found
+func (k requestKey) extract(req *http.Request) (string, bool) {
+	var value string
+
+	switch k.Source {
+	case HashKeySourceHeader:
+		value = req.Header.Get(k.Name)
+	case HashKeySourceCookie:
+		if cookie, err := req.Cookie(k.Name); err == nil {
+			value = cookie.Value
+		}
+	case HashKeySourceQuery:
+		value = req.URL.Query().Get(k.Name)
+	case HashKeySourcePath:
+		segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		if k.pathSegment < len(segments) {
+			value = segments[k.pathSegment]
+		}
+	}
+
+	return value, value != ""
+}
+
+// hashBucket consistently maps key into one of the splitScale buckets. A key is forwarded to
+// canary when its bucket is lower than the canary weight, so that raising the weight only ever
+// moves keys from main to canary.
+func hashBucket(key string) uint64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return uint64(h.Sum32()) % splitScale
+}
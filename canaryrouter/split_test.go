@@ -0,0 +1,168 @@
+package canaryrouter
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_newSplitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    config.Split
+		wantErr bool
+	}{
+		{name: "default mode", args: config.Split{CanaryWeight: config.Float64(5)}, wantErr: false},
+		{name: "random", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeRandom}, wantErr: false},
+		{name: "deterministic", args: config.Split{CanaryWeight: config.Float64(100), Mode: SplitModeDeterministic}, wantErr: false},
+		{name: "negative weight", args: config.Split{CanaryWeight: config.Float64(-1)}, wantErr: true},
+		{name: "weight above 100", args: config.Split{CanaryWeight: config.Float64(100.5)}, wantErr: true},
+		{name: "unknown mode", args: config.Split{CanaryWeight: config.Float64(5), Mode: "roundrobin"}, wantErr: true},
+		{name: "hash on header", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeHash, HashKey: config.HashKey{Source: HashKeySourceHeader, Name: "X-Customer-Id"}}, wantErr: false},
+		{name: "hash on path segment", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeHash, HashKey: config.HashKey{Source: HashKeySourcePath, Name: "1"}}, wantErr: false},
+		{name: "hash without name", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeHash, HashKey: config.HashKey{Source: HashKeySourceCookie}}, wantErr: true},
+		{name: "hash on bad path segment", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeHash, HashKey: config.HashKey{Source: HashKeySourcePath, Name: "first"}}, wantErr: true},
+		{name: "hash on unknown source", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeHash, HashKey: config.HashKey{Source: "body", Name: "id"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSplitter(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSplitter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_splitter_toCanary(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       config.Split
+		total      int
+		wantCanary int
+	}{
+		{name: "deterministic 0%", args: config.Split{CanaryWeight: config.Float64(0), Mode: SplitModeDeterministic}, total: 1000, wantCanary: 0},
+		{name: "deterministic 5%", args: config.Split{CanaryWeight: config.Float64(5), Mode: SplitModeDeterministic}, total: 1000, wantCanary: 50},
+		{name: "deterministic 25%", args: config.Split{CanaryWeight: config.Float64(25), Mode: SplitModeDeterministic}, total: 8, wantCanary: 2},
+		{name: "deterministic 0.5%", args: config.Split{CanaryWeight: config.Float64(0.5), Mode: SplitModeDeterministic}, total: 1000, wantCanary: 5},
+		{name: "deterministic 100%", args: config.Split{CanaryWeight: config.Float64(100), Mode: SplitModeDeterministic}, total: 1000, wantCanary: 1000},
+		{name: "random 0%", args: config.Split{CanaryWeight: config.Float64(0), Mode: SplitModeRandom}, total: 1000, wantCanary: 0},
+		{name: "random 100%", args: config.Split{CanaryWeight: config.Float64(100), Mode: SplitModeRandom}, total: 1000, wantCanary: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp, err := newSplitter(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotCanary := 0
+			for i := 0; i < tt.total; i++ {
+				toCanary, err := sp.toCanary(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if toCanary {
+					gotCanary++
+				}
+			}
+
+			if gotCanary != tt.wantCanary {
+				t.Errorf("toCanary() canary count = %d, want %d", gotCanary, tt.wantCanary)
+			}
+		})
+	}
+}
+
+func Test_splitter_toCanary_hash(t *testing.T) {
+	newHashSplitter := func(t *testing.T, weight float64, hashKey config.HashKey) *splitter {
+		sp, err := newSplitter(config.Split{CanaryWeight: config.Float64(weight), Mode: SplitModeHash, HashKey: hashKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+
+	headerKey := config.HashKey{Source: HashKeySourceHeader, Name: "X-Customer-Id"}
+
+	t.Run("raising weight only moves keys from main to canary", func(t *testing.T) {
+		weights := []float64{1, 5, 25, 50, 100}
+		splitters := make([]*splitter, len(weights))
+		for i, weight := range weights {
+			splitters[i] = newHashSplitter(t, weight, headerKey)
+		}
+
+		for customerID := 0; customerID < 1000; customerID++ {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Customer-Id", fmt.Sprintf("customer-%d", customerID))
+
+			wasCanary := false
+			for i, sp := range splitters {
+				toCanary, err := sp.toCanary(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wasCanary && !toCanary {
+					t.Fatalf("customer-%d moved back to main when weight raised to %v", customerID, weights[i])
+				}
+				wasCanary = toCanary
+			}
+
+			if !wasCanary {
+				t.Errorf("customer-%d not forwarded to canary at weight 100", customerID)
+			}
+		}
+	})
+
+	t.Run("extract key", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			hashKey config.HashKey
+			setup   func(req *http.Request)
+			wantKey string
+			wantOk  bool
+		}{
+			{name: "header", hashKey: headerKey, setup: func(req *http.Request) { req.Header.Set("X-Customer-Id", "42") }, wantKey: "42", wantOk: true},
+			{name: "missing header", hashKey: headerKey, setup: func(req *http.Request) {}, wantKey: "", wantOk: false},
+			{name: "cookie", hashKey: config.HashKey{Source: HashKeySourceCookie, Name: "uid"}, setup: func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "uid", Value: "42"}) }, wantKey: "42", wantOk: true},
+			{name: "query", hashKey: config.HashKey{Source: HashKeySourceQuery, Name: "uid"}, setup: func(req *http.Request) { req.URL.RawQuery = "uid=42" }, wantKey: "42", wantOk: true},
+			{name: "path segment", hashKey: config.HashKey{Source: HashKeySourcePath, Name: "1"}, setup: func(req *http.Request) { req.URL.Path = "/customers/42/orders" }, wantKey: "42", wantOk: true},
+			{name: "path segment out of range", hashKey: config.HashKey{Source: HashKeySourcePath, Name: "5"}, setup: func(req *http.Request) { req.URL.Path = "/customers/42/orders" }, wantKey: "", wantOk: false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, "http://localhost/foo", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tt.setup(req)
+
+				gotKey, gotOk := newHashSplitter(t, 5, tt.hashKey).extractHashKey(req)
+				if gotKey != tt.wantKey || gotOk != tt.wantOk {
+					t.Errorf("extractHashKey() = (%s, %v), want (%s, %v)", gotKey, gotOk, tt.wantKey, tt.wantOk)
+				}
+			})
+		}
+	})
+
+	t.Run("missing key is an error", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := newHashSplitter(t, 100, headerKey).toCanary(req); err == nil {
+			t.Errorf("toCanary() expected error on missing key")
+		}
+	})
+}
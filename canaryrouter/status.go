@@ -8,4 +8,22 @@ const (
 	// StatusCodeCanary is the expected HTTP status code from sidecar service which will
 	// route traffic to Canary proxy
 	StatusCodeCanary = 200
+
+	// HeaderCanaryTarget is the sidecar response header selecting the name of the canary target
+	// when the sidecar returns StatusCodeCanary. The default canary target is used if it is absent.
+	HeaderCanaryTarget = "X-Canary-Target"
+)
+
+const (
+	// HeaderSetHeader is the sidecar response header instructing to set a request header before
+	// forwarding the request, formatted as "Name: value". It may be repeated.
+	HeaderSetHeader = "X-Canary-Set-Header"
+
+	// HeaderRemoveHeader is the sidecar response header instructing to remove a comma separated list of
+	// request headers before forwarding the request. It may be repeated.
+	HeaderRemoveHeader = "X-Canary-Remove-Header"
+
+	// HeaderRewritePath is the sidecar response header instructing to rewrite the request path before
+	// forwarding the request
+	HeaderRewritePath = "X-Canary-Rewrite-Path"
 )
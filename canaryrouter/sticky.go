@@ -0,0 +1,171 @@
+package canaryrouter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+var affinityEligibleKey = contextKey("affinityEligible")
+
+type contextKey string
+
+// affinity pins a client to the target it has been routed to, by issuing a signed cookie
+// holding the target name and its expiry time. The signature covers the route, so that a cookie
+// issued by a route is not honored by the other ones.
+type affinity struct {
+	cookieName string
+	cookiePath string
+	route      string
+	ttl        time.Duration
+	key        []byte
+}
+
+func newAffinity(stickyConfig config.Sticky, route string) (*affinity, error) {
+	if stickyConfig.CookieName == "" {
+		return nil, errors.New("sticky cookie-name must not be empty")
+	}
+
+	if stickyConfig.TTL <= 0 {
+		return nil, errors.Errorf("sticky ttl must be positive, got %d", stickyConfig.TTL)
+	}
+
+	return &affinity{
+		cookieName: stickyConfig.CookieName,
+		cookiePath: "/",
+		route:      route,
+		ttl:        time.Duration(stickyConfig.TTL) * time.Second,
+		key:        []byte(stickyConfig.SigningKey),
+	}, nil
+}
+
+func (a *affinity) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.key)
+	_, _ = mac.Write([]byte(a.route + "\x00" + payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookie creates a new affinity cookie pinning to target
+func (a *affinity) cookie(target string, now time.Time) *http.Cookie {
+	payload := fmt.Sprintf("%s.%d", target, now.Add(a.ttl).Unix())
+
+	return &http.Cookie{
+		Name:     a.cookieName,
+		Value:    payload + "." + a.sign(payload),
+		Path:     a.cookiePath,
+		MaxAge:   int(a.ttl.Seconds()),
+		HttpOnly: true,
+	}
+}
+
+// pinnedTarget returns the target pinned by the request affinity cookie, if it is present,
+// correctly signed for the route and not expired yet
+func (a *affinity) pinnedTarget(req *http.Request, now time.Time) (string, bool) {
+	// NOTE: The client may send the cookies of several routes under the same name, e.g. those of the
+	// top level configuration and of a route with a path prefix
+	for _, cookie := range req.Cookies() {
+		if cookie.Name != a.cookieName {
+			continue
+		}
+
+		if target, ok := a.verify(cookie.Value, now); ok {
+			return target, true
+		}
+	}
+
+	return "", false
+}
+
+// verify returns the target of the affinity cookie value, or false if it is not correctly signed or
+// has expired
+func (a *affinity) verify(value string, now time.Time) (string, bool) {
+	lastDot := strings.LastIndex(value, ".")
+	if lastDot < 0 {
+		return "", false
+	}
+
+	payload, signature := value[:lastDot], value[lastDot+1:]
+	if !hmac.Equal([]byte(signature), []byte(a.sign(payload))) {
+		return "", false
+	}
+
+	// NOTE: The target name may contain dots, the expiry is after the last one
+	lastDot = strings.LastIndex(payload, ".")
+	if lastDot < 0 {
+		return "", false
+	}
+
+	expiry, err := strconv.ParseInt(payload[lastDot+1:], 10, 64)
+	if err != nil || now.Unix() >= expiry {
+		return "", false
+	}
+
+	return payload[:lastDot], true
+}
+
+func (s *Server) isAffinityEnabled() bool {
+	return s.affinity != nil
+}
+
+// viaAffinity honors the affinity cookie before calling next
+func (s *Server) viaAffinity(next http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		targetName, pinned := s.affinity.pinnedTarget(req, time.Now())
+		if !pinned {
+			next(w, req)
+			return
+		}
+
+		if targetName == TargetMain {
+			req = setRoutingReason(req, "Pinned to main by affinity cookie")
+			s.serveMain(w, req)
+			return
+		}
+
+		// NOTE: The pinned target may have been removed from the configuration since
+		target, ok := s.canaryTargets[targetName]
+		if !ok {
+			next(w, req)
+			return
+		}
+
+		s.serveCanaryWithinLimit(w, req, target, fmt.Sprintf("Pinned to %s by affinity cookie", target.name))
+	}
+}
+
+// markAffinityEligible marks the request to be pinned to whichever target it is forwarded to.
+// It should only be used once the routing decision has been made, so that fallbacks caused by
+// errors are not pinned.
+func markAffinityEligible(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), affinityEligibleKey, true))
+}
+
+// clearAffinityEligible removes the mark set by markAffinityEligible, so that the request is not pinned to
+// the target it falls back to
+func clearAffinityEligible(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), affinityEligibleKey, false))
+}
+
+// pinAffinity sets the affinity cookie for target on the response, if the request is eligible
+func (s *Server) pinAffinity(w http.ResponseWriter, req *http.Request, target string) {
+	if !s.isAffinityEnabled() {
+		return
+	}
+
+	if eligible, _ := req.Context().Value(affinityEligibleKey).(bool); !eligible {
+		return
+	}
+
+	http.SetCookie(w, s.affinity.cookie(target, time.Now()))
+}
@@ -0,0 +1,59 @@
+package canaryrouter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+)
+
+func Test_affinity_pinnedTarget(t *testing.T) {
+	a, err := newAffinity(config.Sticky{SigningKey: "s3cr3t", CookieName: "affinity", TTL: 60}, DefaultRouteName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := newAffinity(config.Sticky{SigningKey: "s3cr3t", CookieName: "affinity", TTL: 60}, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuedAt := time.Unix(1500000000, 0)
+	cookie := a.cookie("canary", issuedAt)
+	dottedCookie := a.cookie("candidate.v2", issuedAt)
+	otherRouteCookie := other.cookie("canary", issuedAt)
+
+	tests := []struct {
+		name       string
+		cookies    []string
+		now        time.Time
+		wantTarget string
+		wantPinned bool
+	}{
+		{name: "valid", cookies: []string{cookie.Value}, now: issuedAt.Add(30 * time.Second), wantTarget: "canary", wantPinned: true},
+		{name: "target with dot", cookies: []string{dottedCookie.Value}, now: issuedAt, wantTarget: "candidate.v2", wantPinned: true},
+		{name: "expired", cookies: []string{cookie.Value}, now: issuedAt.Add(60 * time.Second), wantTarget: "", wantPinned: false},
+		{name: "tampered target", cookies: []string{"main" + cookie.Value[len("canary"):]}, now: issuedAt, wantTarget: "", wantPinned: false},
+		{name: "issued by another route", cookies: []string{otherRouteCookie.Value}, now: issuedAt, wantTarget: "", wantPinned: false},
+		{name: "along with another route cookie", cookies: []string{otherRouteCookie.Value, cookie.Value}, now: issuedAt, wantTarget: "canary", wantPinned: true},
+		{name: "no signature", cookies: []string{"canary"}, now: issuedAt, wantTarget: "", wantPinned: false},
+		{name: "empty", cookies: []string{""}, now: issuedAt, wantTarget: "", wantPinned: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: "affinity", Value: value})
+			}
+
+			gotTarget, gotPinned := a.pinnedTarget(req, tt.now)
+			if gotTarget != tt.wantTarget || gotPinned != tt.wantPinned {
+				t.Errorf("pinnedTarget() = (%s, %v), want (%s, %v)", gotTarget, gotPinned, tt.wantTarget, tt.wantPinned)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package canaryrouter
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/ratelimit"
+	log "github.com/sirupsen/logrus"
+	"github.com/tiket-libre/canary-router/canaryrouter/config"
+	"github.com/tiket-libre/canary-router/canaryrouter/instrumentation"
+)
+
+const (
+	// TargetMain is the name of the main target
+	TargetMain = "main"
+
+	// TargetCanary is the name of the default canary target, configured by canary-target
+	TargetCanary = "canary"
+)
+
+// canaryTarget is an upstream which receives canary traffic, guarded by its own circuit breaker
+type canaryTarget struct {
+	name               string
+	proxy              *httputil.ReverseProxy
+	requestLimitBucket *ratelimit.Bucket
+	breaker            *circuitBreaker
+	metricCtx          context.Context
+
+	// inflight is the number of requests being served by the target, it is accessed atomically
+	inflight    int64
+	maxInflight int64
+}
+
+func newCanaryTarget(name string, targetConfig config.Target, logConfig config.Log, mainLatencyWindow *latencyWindow, metricCtx context.Context) (*canaryTarget, error) {
+	proxy, err := newReverseProxy(targetConfig.URL, targetConfig.HeaderHost, logConfig.DebugResponseBody)
+	if err != nil {
+		return nil, errors.Annotatef(err, "target %s", name)
+	}
+	proxy.Transport = newTransport(targetConfig.Client)
+	proxy.ErrorLog = stdlog.New(os.Stderr, fmt.Sprintf("[proxy-%s] ", name), stdlog.LstdFlags|stdlog.Llongfile)
+
+	target := &canaryTarget{
+		name:  name,
+		proxy: proxy,
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.WithField("proxy", name).Infof("http: proxy error: %v", err)
+		if target.isErrorLimited() {
+			target.breaker.record(req, true, time.Now())
+		}
+
+		// NOTE: Let the request be retried against main instead of responding 502
+		if fw, ok := w.(*fallbackWriter); ok && fw.proxyError() {
+			return
+		}
+
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	if targetConfig.CircuitBreaker.MaxInflightCanary < 0 {
+		return nil, errors.Errorf("target %s circuit-breaker max-inflight-canary must be positive, got %d", name, targetConfig.CircuitBreaker.MaxInflightCanary)
+	}
+	target.maxInflight = targetConfig.CircuitBreaker.MaxInflightCanary
+
+	target.requestLimitBucket, err = newRequestLimitBucket(targetConfig.CircuitBreaker)
+	if err != nil {
+		return nil, errors.Annotatef(err, "target %s", name)
+	}
+
+	metricCtx, err = instrumentation.AddTargetTag(metricCtx, name)
+	if err != nil {
+		log.Errorln(err)
+	}
+	target.metricCtx = metricCtx
+
+	target.breaker, err = newCircuitBreaker(targetConfig.CircuitBreaker, mainLatencyWindow, target.describe, metricCtx)
+	if err != nil {
+		return nil, errors.Annotatef(err, "target %s", name)
+	}
+
+	if target.isErrorLimited() {
+		currentModifyResponse := proxy.ModifyResponse
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if currentModifyResponse != nil {
+				_ = currentModifyResponse(resp)
+			}
+
+			isError := isErrorStatusCode(resp.StatusCode)
+			if isError {
+				log.Printf("%s. StatusCode:%d Status:%s", target.describe("returns non 2xx"), resp.StatusCode, resp.Status)
+			}
+
+			target.breaker.record(resp.Request, isError, time.Now())
+
+			return nil
+		}
+	}
+
+	return target, nil
+}
+
+func (t *canaryTarget) isRequestLimited() bool {
+	return t.requestLimitBucket != nil
+}
+
+func (t *canaryTarget) isErrorLimited() bool {
+	return t.breaker != nil
+}
+
+// describe prefixes msg with the target, e.g. "Canary request limit reached" for the default canary
+// target, or "Canary beta request limit reached" for a target named beta
+func (t *canaryTarget) describe(msg string) string {
+	if t.name == TargetCanary {
+		return "Canary " + msg
+	}
+
+	return fmt.Sprintf("Canary %s %s", t.name, msg)
+}
+
+// limitReason returns the reason why the target may not receive any more request,
+// or false if none of its circuit breaker limits has been reached yet
+func (t *canaryTarget) limitReason() (string, bool) {
+	if t.isRequestLimited() && t.availableRequests() <= 0 {
+		return t.describe("request limit reached"), true
+	}
+
+	if t.isErrorLimited() {
+		return t.breaker.limitReason(time.Now())
+	}
+
+	return "", false
+}
+
+// peekLimitReason is limitReason without changing the circuit breaker state
+func (t *canaryTarget) peekLimitReason() (string, bool) {
+	if t.isRequestLimited() && t.availableRequests() <= 0 {
+		return t.describe("request limit reached"), true
+	}
+
+	if t.isErrorLimited() {
+		return t.breaker.peekLimitReason(time.Now())
+	}
+
+	return "", false
+}
+
+// availableRequests returns the remaining request limit of the target, recording it so the budget metric
+// stays current while the limit is reached or refilled by the rate
+func (t *canaryTarget) availableRequests() int64 {
+	available := t.requestLimitBucket.Available()
+	instrumentation.RecordCanaryRequestBudget(t.metricCtx, available)
+
+	return available
+}
+
+// takeRequest consumes the request limit of the target, and a probe if its circuit breaker is half-open.
+// It returns false if the limit has been reached, or if all the probes have been taken.
+func (t *canaryTarget) takeRequest(req *http.Request) (*http.Request, bool) {
+	if t.isRequestLimited() {
+		taken := t.requestLimitBucket.TakeAvailable(1)
+		t.availableRequests()
+
+		if taken == 0 {
+			return req, false
+		}
+	}
+
+	if t.isErrorLimited() {
+		return t.breaker.takeProbe(req)
+	}
+
+	return req, true
+}
+
+// releaseRequest gives the circuit breaker probe taken by takeRequest back, for a request which could not
+// be forwarded to the target. The request limit is not given back.
+func (t *canaryTarget) releaseRequest(req *http.Request) {
+	if t.isErrorLimited() {
+		t.breaker.releaseProbe(req)
+	}
+}
+
+// acquireInflight counts a request being served by the target, it returns false if max-inflight-canary
+// has been reached. Every successful call must be paired with releaseInflight.
+func (t *canaryTarget) acquireInflight() bool {
+	for {
+		inflight := atomic.LoadInt64(&t.inflight)
+		if t.maxInflight > 0 && inflight >= t.maxInflight {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&t.inflight, inflight, inflight+1) {
+			instrumentation.RecordCanaryInflight(t.metricCtx, inflight+1)
+			return true
+		}
+	}
+}
+
+// recordLatency feeds the latency limits of the target circuit breaker with the request latency
+func (t *canaryTarget) recordLatency(ctx context.Context) {
+	if !t.isErrorLimited() {
+		return
+	}
+
+	if latency, ok := instrumentation.Latency(ctx); ok {
+		t.breaker.recordLatency(latency, time.Now())
+	}
+}
+
+func (t *canaryTarget) releaseInflight() {
+	instrumentation.RecordCanaryInflight(t.metricCtx, atomic.AddInt64(&t.inflight, -1))
+}
+
+// newCanaryTargets builds the default canary target and the additional named targets
+func newCanaryTargets(cfg config.Config, mainLatencyWindow *latencyWindow, metricCtx context.Context) (map[string]*canaryTarget, error) {
+	targetsConfig := map[string]config.Target{
+		TargetCanary: {
+			URL:            cfg.CanaryTarget,
+			HeaderHost:     cfg.CanaryHeaderHost,
+			Client:         cfg.Client.MainAndCanary,
+			CircuitBreaker: cfg.CircuitBreaker,
+		},
+	}
+
+	for name, targetConfig := range cfg.Targets {
+		name = strings.ToLower(name)
+		if _, exists := targetsConfig[name]; exists || name == TargetMain {
+			return nil, errors.Errorf("target name %q is reserved", name)
+		}
+
+		if targetConfig.Client == (config.HTTPClientConfig{}) {
+			targetConfig.Client = cfg.Client.MainAndCanary
+		}
+
+		targetsConfig[name] = targetConfig
+	}
+
+	targets := make(map[string]*canaryTarget, len(targetsConfig))
+	for name, targetConfig := range targetsConfig {
+		target, err := newCanaryTarget(name, targetConfig, cfg.Log, mainLatencyWindow, metricCtx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		targets[name] = target
+	}
+
+	return targets, nil
+}
+
+// hasLatencyRatio returns whether any canary target compares its latency with the main latency
+func hasLatencyRatio(cfg config.Config) bool {
+	if cfg.CircuitBreaker.LatencyRatio != 0 {
+		return true
+	}
+
+	for _, targetConfig := range cfg.Targets {
+		if targetConfig.CircuitBreaker.LatencyRatio != 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -27,6 +27,10 @@ var (
 			Level:            "info",
 			DebugRequestBody: false,
 		},
+		Sticky: config.Sticky{
+			CookieName: "canary-router-affinity",
+			TTL:        3600,
+		},
 		Server: config.HTTPServerConfig{
 			ReadTimeout:  5,
 			WriteTimeout: 15,
@@ -2,4 +2,9 @@ module canary-sidecar
 
 go 1.12
 
-require github.com/tiket-libre/canary-router v1.0.7
+require (
+	github.com/tiket-libre/canary-router v1.0.7
+	google.golang.org/grpc v1.26.0
+)
+
+replace github.com/tiket-libre/canary-router => ../..
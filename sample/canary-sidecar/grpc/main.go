@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/tiket-libre/canary-router/canaryrouter"
+	"github.com/tiket-libre/canary-router/canaryrouter/sidecarpb"
+	"google.golang.org/grpc"
+)
+
+// sidecar is the gRPC counterpart of the HTTP sample sidecar, used with a grpc:// sidecar-url
+type sidecar struct{}
+
+func (sidecar) Decide(ctx context.Context, in *sidecarpb.DecideRequest) (*sidecarpb.DecideResponse, error) {
+	log.Printf("Origin http req: %s %s", in.Method, in.Path)
+
+	if string(in.Body) == "type=2" {
+		return &sidecarpb.DecideResponse{
+			Target:     canaryrouter.TargetCanary,
+			Reason:     "type 2",
+			CacheTtl:   60,
+			SetHeaders: map[string]string{"X-Tenant-Id": "2"},
+		}, nil
+	}
+
+	return &sidecarpb.DecideResponse{Target: canaryrouter.TargetMain, Reason: "type 1"}, nil
+}
+
+func main() {
+	port := os.Getenv("PORT")
+	log.Printf("Start canary gRPC sidecar server at port %s", port)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	sidecarpb.RegisterSidecarServer(server, sidecar{})
+
+	if err := server.Serve(listener); err != nil {
+		log.Fatal(err)
+	}
+}
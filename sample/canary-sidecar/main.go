@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,6 +13,7 @@ import (
 
 func main() {
 
+	// sidecar-protocol "status-code" (default): the decision is the response status code
 	http.HandleFunc("/sidecar/", func(w http.ResponseWriter, req *http.Request) {
 		bodyBytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -32,6 +34,32 @@ func main() {
 		}
 	})
 
+	// sidecar-protocol "json": the decision is the JSON body of a 200 response
+	http.HandleFunc("/sidecar-json/", func(w http.ResponseWriter, req *http.Request) {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Printf("Failed to read req.Body: +%v", err)
+
+			writeDecision(w, canaryrouter.SidecarResponse{Target: canaryrouter.TargetMain, Reason: "unreadable body"})
+			return
+		}
+
+		log.Printf("Origin http req: %+v", req)
+
+		if string(bodyBytes) == "type=2" {
+			cacheTTL := 60
+			writeDecision(w, canaryrouter.SidecarResponse{
+				Target:     canaryrouter.TargetCanary,
+				Reason:     "type 2",
+				CacheTTL:   &cacheTTL,
+				SetHeaders: map[string]string{"X-Tenant-Id": "2"},
+			})
+			return
+		}
+
+		writeDecision(w, canaryrouter.SidecarResponse{Target: canaryrouter.TargetMain, Reason: "type 1"})
+	})
+
 	port := os.Getenv("PORT")
 	log.Printf("Start canary sidecar server at port %s", port)
 
@@ -39,3 +67,11 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func writeDecision(w http.ResponseWriter, decision canaryrouter.SidecarResponse) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(decision); err != nil {
+		log.Printf("Failed to write decision: +%v", err)
+	}
+}